@@ -2,6 +2,9 @@ package cluster
 
 import (
 	"net"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/memberlist"
 )
@@ -22,39 +25,167 @@ type RemoteCluster interface {
 type Cluster interface {
 	Self() Node
 	Members() []Node
+	// Watch calls fn with every change to the membership of the
+	// cluster, until stop is called.
+	Watch(fn func(Event)) (stop func())
 	Leave() error
 	// additional stuff
 }
 
+type EventType int
+
+const (
+	NodeJoin EventType = iota
+	NodeLeave
+	NodeUpdate
+)
+
+func (et EventType) String() string {
+	switch et {
+	case NodeJoin:
+		return "join"
+	case NodeLeave:
+		return "leave"
+	case NodeUpdate:
+		return "update"
+	}
+	return "EventType(" + strconv.Itoa(int(et)) + ")"
+}
+
+// Event is a change in the membership of a cluster.
+type Event struct {
+	Type EventType
+	Node Node
+	// Prev is what the node was before an update.
+	Prev Node
+}
+
+// how long to wait for our updates to reach the cluster
+const gossipTimeout = 5 * time.Second
+
+// Gossip discovers the members of a cluster using the memberlist
+// gossip protocol. A nil config uses memberlist.DefaultLANConfig.
+//
+// Nodes announce the address on which they serve RPCs as their
+// memberlist metadata. Members that haven't announced an address
+// yet aren't part of the cluster.
+func Gossip(cfg *memberlist.Config) Discovery {
+	if cfg == nil {
+		cfg = memberlist.DefaultLANConfig()
+	}
+	return &gossipDiscovery{cfg: cfg}
+}
+
 type gossipDiscovery struct {
-	// nothing
+	cfg *memberlist.Config
 }
 
 func (gd *gossipDiscovery) Discover(addrs ...string) (RemoteCluster, error) {
-	cfg := memberlist.DefaultLANConfig()
-	list, err := memberlist.Create(cfg)
+	var (
+		meta = new(metaDelegate)
+		// memberlist notifies us while holding its locks, so events
+		// are queued and dispatched on their own goroutine
+		events = make(chan memberlist.NodeEvent, 256)
+		done   = make(chan struct{})
+	)
+
+	cfg := *gd.cfg
+	cfg.Delegate = meta
+	cfg.Events = &copyEventDelegate{ch: events, done: done}
+	list, err := memberlist.Create(&cfg)
 	if err != nil {
 		return nil, err
 	}
-	_, err = list.Join(addrs)
-	if err != nil {
-		return nil, err
+	gc := &gossipCluster{
+		list:  list,
+		meta:  meta,
+		nodes: make(map[string]Node),
+		done:  done,
 	}
+	go gc.dispatch(events)
 
-	return &gossipCluster{list: list}, nil
+	if len(addrs) != 0 {
+		if _, err := list.Join(addrs); err != nil {
+			_ = gc.shutdown()
+			return nil, err
+		}
+	}
+	return gc, nil
 }
 
 type gossipCluster struct {
 	list *memberlist.Memberlist
+	meta *metaDelegate
+
+	watchers Watchers
+
+	// nodes that announced an address, by name. Reading the nodes
+	// returned by memberlist races with its updates, so we keep
+	// track of them from its events instead.
+	nodesMu sync.RWMutex
+	nodes   map[string]Node
+
+	done     chan struct{}
+	doneOnce sync.Once
 }
 
-func (gd *gossipCluster) Members() []Node {
+func (gd *gossipCluster) shutdown() error {
+	gd.doneOnce.Do(func() { close(gd.done) })
+	return gd.list.Shutdown()
+}
+
+// dispatch turns memberlist events into events about nodes that
+// announced an address, and passes them to the watchers.
+func (gd *gossipCluster) dispatch(events <-chan memberlist.NodeEvent) {
+	for {
+		var ev memberlist.NodeEvent
+		select {
+		case ev = <-events:
+		case <-gd.done:
+			return
+		}
+
+		if ev, ok := gd.track(ev); ok {
+			gd.watchers.Notify(ev)
+		}
+	}
+}
+
+func (gd *gossipCluster) track(ev memberlist.NodeEvent) (Event, bool) {
+	gd.nodesMu.Lock()
+	defer gd.nodesMu.Unlock()
+
+	name := ev.Node.Name
+	prev, known := gd.nodes[name]
+	cur := Node{Addr: string(ev.Node.Meta)}
+	serving := ev.Event != memberlist.NodeLeave && cur.Addr != ""
 
-	// gd.list.SendToTCP
+	switch {
+	case !known && serving:
+		gd.nodes[name] = cur
+		return Event{Type: NodeJoin, Node: cur}, true
+	case known && serving && prev != cur:
+		gd.nodes[name] = cur
+		return Event{Type: NodeUpdate, Node: cur, Prev: prev}, true
+	case known && !serving:
+		delete(gd.nodes, name)
+		return Event{Type: NodeLeave, Node: prev}, true
+	}
+	return Event{}, false
+}
 
-	// TODO: discover what ports people are listening on
+func (gd *gossipCluster) Watch(fn func(Event)) (stop func()) {
+	return gd.watchers.Watch(fn)
+}
 
-	return nil
+func (gd *gossipCluster) Members() []Node {
+	gd.nodesMu.RLock()
+	defer gd.nodesMu.RUnlock()
+	nodes := make([]Node, 0, len(gd.nodes))
+	for _, nd := range gd.nodes {
+		nodes = append(nodes, nd)
+	}
+	return nodes
 }
 
 func (gd *gossipCluster) Join(cb func(ip string) (net.Addr, error)) (Cluster, error) {
@@ -63,8 +194,74 @@ func (gd *gossipCluster) Join(cb func(ip string) (net.Addr, error)) (Cluster, er
 		return nil, err
 	}
 
-	// TODO: announce to people that we are listening on "addr"
-	_ = addr
+	// announce to people that we are listening on "addr"
+	gd.meta.set([]byte(addr.String()))
+	if err := gd.list.UpdateNode(gossipTimeout); err != nil {
+		return nil, err
+	}
+
+	return &gossipMember{gossipCluster: gd, self: Node{Addr: addr.String()}}, nil
+}
 
-	return nil, nil
+type gossipMember struct {
+	*gossipCluster
+	self Node
 }
+
+func (gm *gossipMember) Self() Node { return gm.self }
+
+func (gm *gossipMember) Leave() error {
+	if err := gm.list.Leave(gossipTimeout); err != nil {
+		_ = gm.shutdown()
+		return err
+	}
+	return gm.shutdown()
+}
+
+// copyEventDelegate queues copies of the nodes it's notified about,
+// since memberlist keeps mutating them. Events are dropped once the
+// cluster is shutdown.
+type copyEventDelegate struct {
+	ch   chan<- memberlist.NodeEvent
+	done <-chan struct{}
+}
+
+func (ced *copyEventDelegate) notify(et memberlist.NodeEventType, n *memberlist.Node) {
+	cp := *n
+	cp.Meta = append([]byte(nil), n.Meta...)
+	select {
+	case ced.ch <- memberlist.NodeEvent{Event: et, Node: &cp}:
+	case <-ced.done:
+	}
+}
+
+func (ced *copyEventDelegate) NotifyJoin(n *memberlist.Node)   { ced.notify(memberlist.NodeJoin, n) }
+func (ced *copyEventDelegate) NotifyLeave(n *memberlist.Node)  { ced.notify(memberlist.NodeLeave, n) }
+func (ced *copyEventDelegate) NotifyUpdate(n *memberlist.Node) { ced.notify(memberlist.NodeUpdate, n) }
+
+// metaDelegate gossips the metadata of the local node. It doesn't
+// exchange any other state.
+type metaDelegate struct {
+	mu   sync.Mutex
+	meta []byte
+}
+
+func (md *metaDelegate) set(meta []byte) {
+	md.mu.Lock()
+	md.meta = meta
+	md.mu.Unlock()
+}
+
+func (md *metaDelegate) NodeMeta(limit int) []byte {
+	md.mu.Lock()
+	defer md.mu.Unlock()
+	if len(md.meta) > limit {
+		return nil
+	}
+	return md.meta
+}
+
+func (md *metaDelegate) NotifyMsg([]byte)                           {}
+func (md *metaDelegate) GetBroadcasts(overhead, limit int) [][]byte { return nil }
+func (md *metaDelegate) LocalState(join bool) []byte                { return nil }
+func (md *metaDelegate) MergeRemoteState(buf []byte, join bool)     {}
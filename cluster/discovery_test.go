@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/memberlist"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGossip(t *testing.T) {
+	const n = 3
+
+	var (
+		clusters []Cluster
+		want     []Node
+		seed     string
+	)
+	for i := 0; i < n; i++ {
+		cfg := memberlist.DefaultLocalConfig()
+		cfg.Name = fmt.Sprintf("node-%d", i)
+		cfg.BindAddr = "127.0.0.1"
+		cfg.BindPort = 0
+		cfg.LogOutput = ioutil.Discard
+
+		var seeds []string
+		if seed != "" {
+			seeds = append(seeds, seed)
+		}
+		rc, err := Gossip(cfg).Discover(seeds...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seed == "" {
+			seed = net.JoinHostPort("127.0.0.1", strconv.Itoa(int(rc.(*gossipCluster).list.LocalNode().Port)))
+		}
+
+		// pretend we're serving RPCs on a port unique to this node
+		lc, err := rc.Join(func(ip string) (net.Addr, error) {
+			return &net.TCPAddr{IP: net.ParseIP(ip), Port: 10000 + i}, nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		clusters = append(clusters, lc)
+		want = append(want, lc.Self())
+	}
+	defer func() {
+		for _, lc := range clusters[1:] {
+			_ = lc.Leave()
+		}
+	}()
+	sortNodes(want)
+
+	for _, lc := range clusters {
+		waitFor(t, func() bool { return len(lc.Members()) == n })
+		got := lc.Members()
+		sortNodes(got)
+		assert.Equal(t, want, got)
+	}
+
+	var (
+		eventsMu sync.Mutex
+		events   []Event
+	)
+	stop := clusters[1].Watch(func(ev Event) {
+		eventsMu.Lock()
+		events = append(events, ev)
+		eventsMu.Unlock()
+	})
+	defer stop()
+
+	// the first node leaves, everybody else should notice
+	if err := clusters[0].Leave(); err != nil {
+		t.Fatal(err)
+	}
+	for _, lc := range clusters[1:] {
+		waitFor(t, func() bool { return len(lc.Members()) == n-1 })
+		got := lc.Members()
+		sortNodes(got)
+		assert.Equal(t, want[1:], got)
+	}
+
+	waitFor(t, func() bool {
+		eventsMu.Lock()
+		defer eventsMu.Unlock()
+		return len(events) != 0
+	})
+	eventsMu.Lock()
+	assert.Equal(t, []Event{{Type: NodeLeave, Node: want[0]}}, events)
+	eventsMu.Unlock()
+}
+
+func sortNodes(nodes []Node) {
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Addr < nodes[j].Addr })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met in time")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,41 @@
+package cluster
+
+import "sync"
+
+// Watchers is a set of functions to notify of cluster events, for
+// implementations of Cluster. Its zero value is ready to use.
+type Watchers struct {
+	mu   sync.Mutex
+	next int
+	fns  map[int]func(Event)
+}
+
+// Watch adds fn to the set, until stop is called.
+func (ws *Watchers) Watch(fn func(Event)) (stop func()) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.fns == nil {
+		ws.fns = make(map[int]func(Event))
+	}
+	id := ws.next
+	ws.next++
+	ws.fns[id] = fn
+	return func() {
+		ws.mu.Lock()
+		delete(ws.fns, id)
+		ws.mu.Unlock()
+	}
+}
+
+// Notify calls every function in the set with ev.
+func (ws *Watchers) Notify(ev Event) {
+	ws.mu.Lock()
+	fns := make([]func(Event), 0, len(ws.fns))
+	for _, fn := range ws.fns {
+		fns = append(fns, fn)
+	}
+	ws.mu.Unlock()
+	for _, fn := range fns {
+		fn(ev)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/aybabtme/log"
+)
+
+func dialNode(addr string) merkle.Store {
+	cd := codec.Binary()
+	switch *blobCdc {
+	case "json":
+		cd = codec.JSON()
+	case "cbor":
+		cd = codec.CBOR()
+	}
+	opts := clientToken()
+	if *tlsCert != "" || *tlsCA != "" {
+		_, cliTLS, err := store.LoadTLS(*tlsCert, *tlsKey, *tlsCA, false)
+		if err != nil {
+			log.Err(err).Fatal("can't load TLS certificates")
+		}
+		opts = append(opts, store.ClientTLS(cliTLS))
+	}
+	cl, err := store.HTTPClient(addr, cd, &http.Client{}, opts...)
+	if err != nil {
+		log.Err(err).Fatal("can't make client")
+	}
+	return cl
+}
+
+func runBlobPut(addr, filename, chunker string, blobSize int64, parallelism int, hashOpts []merkle.Option) {
+	ctx := context.Background()
+
+	var r io.Reader = os.Stdin
+	if filename != "" && filename != "-" {
+		f, err := os.Open(filename)
+		if err != nil {
+			log.Err(err).Fatal("can't open file")
+		}
+		defer f.Close()
+		r = f
+	}
+
+	chunking := merkle.FixedSize(blobSize)
+	if chunker == "cdc" {
+		if blobSize < 4 {
+			log.Fatal("blob size is too small for content-defined chunking")
+		}
+		chunking = merkle.FastCDC(int(blobSize/4), int(blobSize), int(blobSize*4))
+	}
+
+	opts := append([]merkle.Option{
+		merkle.WithChunker(chunking),
+		merkle.WithParallelism(parallelism),
+		// keep about two chunks in flight per upload
+		merkle.WithMaxInFlight(2 * int64(parallelism) * blobSize),
+	}, hashOpts...)
+	tree, sum, err := merkle.Build(ctx, r, dialNode(addr), opts...)
+	if err != nil {
+		log.Err(err).Fatal("can't put blob")
+	}
+	if tree == nil {
+		log.Fatal("nothing to put, input was empty")
+	}
+	fmt.Println(sum.String())
+}
+
+func runBlobGet(addr, sumStr string, parallelism int, hashOpts []merkle.Option) {
+	ctx := context.Background()
+
+	sum, err := thash.ParseSum(sumStr)
+	if err != nil {
+		log.Err(err).Fatal("invalid sum")
+	}
+	remote := dialNode(addr)
+
+	tree, err := merkle.RetrieveTree(ctx, sum, remote)
+	if err != nil {
+		log.Err(err).Fatal("can't retrieve tree")
+	}
+	opts := append([]merkle.Option{merkle.WithParallelism(parallelism)}, hashOpts...)
+	invalid, err := tree.Retrieve(ctx, os.Stdout, remote, opts...)
+	for _, subtree := range invalid {
+		log.KV("sum", subtree.HashSum.String()).
+			KV("size_byte", subtree.SizeByte).
+			Error("invalid subtree")
+	}
+	if err != nil {
+		log.Err(err).Fatal("can't retrieve blob")
+	}
+	if len(invalid) != 0 {
+		log.KV("count", len(invalid)).Fatal("retrieved blob is invalid")
+	}
+}
+
+func runBlobInfo(addr, sumStr string, asJSON bool) {
+	ctx := context.Background()
+
+	sum, err := thash.ParseSum(sumStr)
+	if err != nil {
+		log.Err(err).Fatal("invalid sum")
+	}
+
+	tree, err := merkle.RetrieveTree(ctx, sum, dialNode(addr))
+	if err != nil {
+		log.Err(err).Fatal("can't retrieve tree")
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(tree); err != nil {
+			log.Err(err).Fatal("can't print tree")
+		}
+		return
+	}
+
+	fmt.Printf("sum:  %s\n", tree.HashSum.String())
+	fmt.Printf("size: %d\n", tree.SizeByte)
+	fmt.Printf("blobs:\n")
+	var offset int64
+	printLeaves(tree, func(leaf *merkle.Tree) {
+		fmt.Printf("  %12d %12d %s\n", offset, leaf.SizeByte, leaf.HashSum.String())
+		offset += leaf.SizeByte
+	})
+}
+
+func runBlobUpgrade(addr, sumStr string) {
+	ctx := context.Background()
+
+	sum, err := thash.ParseSum(sumStr)
+	if err != nil {
+		log.Err(err).Fatal("invalid sum")
+	}
+
+	tree, err := merkle.Upgrade(ctx, sum, dialNode(addr))
+	if err != nil {
+		log.Err(err).Fatal("can't upgrade tree")
+	}
+	log.KV("sum", tree.HashSum.String()).
+		KV("size_byte", tree.SizeByte).
+		Info("upgraded")
+}
+
+func printLeaves(tree *merkle.Tree, fn func(*merkle.Tree)) {
+	if tree.Start == nil && tree.End == nil {
+		fn(tree)
+		return
+	}
+	printLeaves(tree.Start, fn)
+	printLeaves(tree.End, fn)
+}
+
+var hashTypes = []thash.Type{
+	thash.Blake2B512,
+	thash.Blake2B256,
+	thash.SHA256,
+	thash.Blake3,
+	thash.SHA3,
+}
+
+func hashNames() []string {
+	var names []string
+	for _, typ := range hashTypes {
+		names = append(names, typ.String())
+	}
+	return names
+}
+
+func hashType(name string) merkle.Option {
+	for _, typ := range hashTypes {
+		if typ.String() == name {
+			return merkle.WithHashType(typ)
+		}
+	}
+	log.KV("hash", name).Fatal("unknown hash function")
+	return nil
+}
+
+func hashKey(filename string) []merkle.Option {
+	if filename == "" {
+		return nil
+	}
+	key, err := ioutil.ReadFile(filename)
+	if err != nil {
+		log.Err(err).Fatal("can't read hash key")
+	}
+	return []merkle.Option{merkle.WithHashKey(bytes.TrimSpace(key))}
+}
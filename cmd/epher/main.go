@@ -1,22 +1,73 @@
 package main
 
 import (
+	"io/ioutil"
+	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/alecthomas/kingpin"
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/service"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/aybabtme/log"
+	"github.com/hashicorp/memberlist"
 )
 
 var (
 	app = kingpin.New("epher", "A highly available, content addressable distributed blob storage.")
 
-	node = app.Command("node", "Join a cluster and become a storage node.")
-	// storage   = node.Flag("store", "Type of storage to use.").Default("memory").Required().Enum("memory", "fs")
-	joinAddrs = node.Flag("addrs", "Addresses of some members of the cluster to join.").Required().Strings()
+	tlsCert   = app.Flag("tls.cert", "PEM file of the certificate to present, to talk to nodes over TLS.").ExistingFile()
+	tlsKey    = app.Flag("tls.key", "PEM file of the key of the certificate.").ExistingFile()
+	tlsCA     = app.Flag("tls.ca", "PEM file of the authorities that issue the certificates of the cluster. Defaults to the roots of the host.").ExistingFile()
+	authToken = app.Flag("auth.token.file", "File holding the token to present to nodes. Nodes present it to their peers, so it needs the peer scope.").ExistingFile()
+
+	node        = app.Command("node", "Join a cluster and become a storage node.")
+	storage     = node.Flag("store", "Type of storage to use.").Default("memory").Enum("memory", "fs")
+	storageDir  = node.Flag("dir", "Directory where the fs storage keeps its data.").Default("epher-data").String()
+	joinAddrs   = node.Flag("addrs", "Addresses of some members of the cluster to join. Forms a new cluster if none are given.").Strings()
+	rpcPort     = node.Flag("port", "Port on which to serve RPCs, picked at random if 0.").Default("0").Int()
+	gossipPort  = node.Flag("gossip.port", "Port on which to gossip with the cluster.").Default("7946").Int()
+	nodeName    = node.Flag("name", "Name of this node, unique in the cluster. Defaults to the hostname.").String()
+	replicas    = node.Flag("replicas", "Number of members of the cluster that keep a copy of each blob.").Default("1").Int()
+	writeQuorum = node.Flag("write.quorum", "Number of replicas that must acknowledge a write.").Default("1").Int()
+	readQuorum  = node.Flag("read.quorum", "Number of replicas that must miss a blob for it to be reported missing.").Default("1").Int()
+	repairEvery = node.Flag("repair.interval", "How often to repair the replicas held by this node, never if 0.").Default("1m").Duration()
+	verifyGets  = node.Flag("verify.gets", "Check that blobs and nodes match their sum when they're read, not only when they're written.").Bool()
+	authTokens  = node.Flag("auth.tokens", "File of the tokens this node accepts, one per line followed by its scopes: read, write and peer, separated by commas. Anyone can talk to the node if absent.").ExistingFile()
+	tlsMutual   = node.Flag("tls.mutual", "Only serve clients that present a certificate issued by --tls.ca.").Bool()
+	maxBlobSize = node.Flag("max.blob.size", "Size of the largest blob this node accepts.").Default("64MiB").Bytes()
 
 	blob     = app.Command("blob", "Manipulate blobs in an epher cluster.")
-	blobPut  = blob.Command("put", "Put a blob in epher.")
-	blobGet  = blob.Command("get", "Get a blob from epher.")
-	blobInfo = blob.Command("info", "Info about a blob in epher.")
+	blobAddr = blob.Flag("addr", "RPC address of the epher node to talk to.").Required().String()
+	blobKey  = blob.Flag("hash.key.file", "File holding the key of keyed hash sums, for private clusters.").ExistingFile()
+	blobCdc  = blob.Flag("codec", "Codec to talk to the node in.").Default("binary").Enum("binary", "json", "cbor")
+
+	blobPut     = blob.Command("put", "Put a blob in epher.")
+	blobPutFile = blobPut.Arg("file", "File to put in epher, reads from stdin if absent.").String()
+	blobPutSize = blobPut.Flag("blob.size", "Size of the chunks the blob is split into, on average with the cdc chunker.").Default("4MiB").Bytes()
+	blobPutPar  = blobPut.Flag("parallelism", "Number of chunks uploaded at once.").Default("4").Int()
+	blobPutCDC  = blobPut.Flag("chunker", "How to split the blob into chunks, fixed size or content-defined.").Default("fixed").Enum("fixed", "cdc")
+	blobPutSep  = blobPut.Flag("domain.separation", "Hash chunks and nodes with distinct prefixes, so a chunk can't pass for a node.").Bool()
+	blobPutHash = blobPut.Flag("hash", "Hash function of the sums, keyed if a key is given.").Default(thash.Blake2B512.String()).Enum(hashNames()...)
+
+	blobGet    = blob.Command("get", "Get a blob from epher.")
+	blobGetSum = blobGet.Arg("sum", "Hash sum of the blob.").Required().String()
+	blobGetPar = blobGet.Flag("parallelism", "Number of chunks fetched ahead.").Default("4").Int()
+
+	blobInfo    = blob.Command("info", "Info about a blob in epher.")
+	blobInfoSum = blobInfo.Arg("sum", "Hash sum of the blob.").Required().String()
+	blobInfoJSN = blobInfo.Flag("json", "Print the whole tree of the blob as JSON.").Bool()
+
+	blobUpgrade    = blob.Command("upgrade", "Rewrite the nodes of a blob put by an older epher, so they describe their children.")
+	blobUpgradeSum = blobUpgrade.Arg("sum", "Hash sum of the blob.").Required().String()
 )
 
 func main() {
@@ -26,18 +77,112 @@ func main() {
 		// join or form a cluster
 		runNode((*joinAddrs)...)
 
-	case blob.FullCommand():
+	case blobPut.FullCommand():
+		hashOpts := append(hashKey(*blobKey), hashType(*blobPutHash))
+		if *blobPutSep {
+			hashOpts = append(hashOpts, merkle.WithDomainSeparation())
+		}
+		runBlobPut(*blobAddr, *blobPutFile, *blobPutCDC, int64(*blobPutSize), *blobPutPar, hashOpts)
+
+	case blobGet.FullCommand():
+		runBlobGet(*blobAddr, *blobGetSum, *blobGetPar, hashKey(*blobKey))
+
+	case blobInfo.FullCommand():
+		runBlobInfo(*blobAddr, *blobInfoSum, *blobInfoJSN)
 
+	case blobUpgrade.FullCommand():
+		runBlobUpgrade(*blobAddr, *blobUpgradeSum)
 	}
 }
 
 func runNode(addrs ...string) {
-	// sd, err := cluster.JoinLAN(addrs...)
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
-	// err = service.Start(sd, store.NewMemoryStore())
-	// if err != nil {
-	// 	log.Fatal(err)
-	// }
+	local, err := openStore(*storage, *storageDir)
+	if err != nil {
+		log.Err(err).Fatal("can't open storage")
+	}
+
+	cfg := memberlist.DefaultLANConfig()
+	cfg.BindPort = *gossipPort
+	cfg.AdvertisePort = *gossipPort
+	if *nodeName != "" {
+		cfg.Name = *nodeName
+	}
+
+	rc, err := cluster.Gossip(cfg).Discover(addrs...)
+	if err != nil {
+		log.Err(err).Fatal("can't discover cluster")
+	}
+
+	cd := codec.Binary(codec.WithMaxBlobSize(int64(*maxBlobSize)))
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	var verify []store.VerifyOption
+	if *verifyGets {
+		verify = append(verify, store.VerifyGets())
+	}
+	opts := []service.Option{
+		service.WithPort(*rpcPort),
+		service.WithReplication(store.Quorum{N: *replicas, W: *writeQuorum, R: *readQuorum}),
+		service.WithRepairInterval(*repairEvery),
+		service.WithVerification(verify...),
+	}
+	var clientOpts []store.ClientOption
+	if *tlsCert != "" || *tlsMutual {
+		srvTLS, cliTLS, err := store.LoadTLS(*tlsCert, *tlsKey, *tlsCA, *tlsMutual)
+		if err != nil {
+			log.Err(err).Fatal("can't load TLS certificates")
+		}
+		opts = append(opts, service.WithTLS(srvTLS))
+		clientOpts = append(clientOpts, store.ClientTLS(cliTLS))
+	}
+	if *authTokens != "" {
+		tokens, err := store.LoadTokens(*authTokens)
+		if err != nil {
+			log.Err(err).Fatal("can't load tokens")
+		}
+		opts = append(opts, service.WithAuth(tokens))
+	}
+	clientOpts = append(clientOpts, clientToken()...)
+	svc, err := service.Start(r, rc, cd, local, func(nd cluster.Node) merkle.Store {
+		cl, err := store.HTTPClient(nd.Addr, cd, &http.Client{}, clientOpts...)
+		if err != nil {
+			log.Err(err).KV("node", nd.Addr).Fatal("can't make client")
+		}
+		return cl
+	}, opts...)
+	if err != nil {
+		log.Err(err).Fatal("can't start service")
+	}
+	log.KV("addr", svc.Addr().String()).KV("store", *storage).Info("node is serving")
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-sigc
+	log.KV("signal", sig.String()).Info("shutting down")
+
+	if err := svc.Close(); err != nil {
+		log.Err(err).Fatal("can't shutdown cleanly")
+	}
+	log.Info("node has left the cluster")
+}
+
+// clientToken authenticates with the token given on the command line,
+// if any.
+func clientToken() []store.ClientOption {
+	if *authToken == "" {
+		return nil
+	}
+	token, err := ioutil.ReadFile(*authToken)
+	if err != nil {
+		log.Err(err).Fatal("can't read token")
+	}
+	return []store.ClientOption{store.ClientToken(strings.TrimSpace(string(token)))}
+}
+
+func openStore(kind, dir string) (merkle.Store, error) {
+	switch kind {
+	case "fs":
+		return store.NewFSStore(dir)
+	default:
+		return store.NewMemoryStore(), nil
+	}
 }
@@ -0,0 +1,477 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// CBOR encodes in CBOR (RFC 8949), for clients in other languages that
+// want something more compact than JSON. Nodes, blobs and infos are maps
+// keyed by the same names as in JSON, and unknown keys are skipped. Sums
+// are CIDs under tag 42, as in IPLD. A blob's data is a byte string, and
+// must be its last key.
+func CBOR(opts ...Option) Codec {
+	return cborCodec{limits: newLimits(opts)}
+}
+
+type cborCodec struct {
+	limits
+}
+
+// major types
+const (
+	cborUint  = 0
+	cborNint  = 1
+	cborBytes = 2
+	cborText  = 3
+	cborArray = 4
+	cborMap   = 5
+	cborTag   = 6
+	cborOther = 7
+)
+
+const (
+	cborCIDTag = 42
+
+	// values nested deeper than this aren't skipped
+	cborMaxDepth = 16
+	// keys longer than this are skipped without being read
+	cborMaxKey = 64
+	// no CID we know of is longer than this
+	cborMaxCID = 128
+)
+
+func (cborCodec) ContentType() string { return "application/cbor" }
+
+func (c cborCodec) DecodeNode(r io.Reader, node *merkle.Node) error {
+	*node = merkle.Node{}
+	err := c.decodeMap(r, func(br byteReader, key string) error {
+		var (
+			err  error
+			kind uint64
+		)
+		switch key {
+		case "sum":
+			err = c.decodeSum(br, &node.Sum)
+		case "start":
+			err = c.decodeSum(br, &node.Start)
+		case "end":
+			err = c.decodeSum(br, &node.End)
+		case "start_kind":
+			kind, err = decodeKind(br)
+			node.StartKind = merkle.ChildKind(kind)
+		case "end_kind":
+			kind, err = decodeKind(br)
+			node.EndKind = merkle.ChildKind(kind)
+		case "start_size":
+			node.StartSize, err = decodeSize(br)
+		case "end_size":
+			node.EndSize, err = decodeSize(br)
+		default:
+			err = skip(br, 0)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.checkNode(*node)
+}
+
+func (c cborCodec) EncodeNode(w io.Writer, node merkle.Node) error {
+	var buf bytes.Buffer
+	writeHead(&buf, cborMap, 7)
+	writeText(&buf, "sum")
+	if err := c.encodeSum(&buf, node.Sum); err != nil {
+		return err
+	}
+	writeText(&buf, "start")
+	if err := c.encodeSum(&buf, node.Start); err != nil {
+		return err
+	}
+	writeText(&buf, "end")
+	if err := c.encodeSum(&buf, node.End); err != nil {
+		return err
+	}
+	writeText(&buf, "start_kind")
+	writeHead(&buf, cborUint, uint64(node.StartKind))
+	writeText(&buf, "end_kind")
+	writeHead(&buf, cborUint, uint64(node.EndKind))
+	writeText(&buf, "start_size")
+	writeHead(&buf, cborUint, uint64(node.StartSize))
+	writeText(&buf, "end_size")
+	writeHead(&buf, cborUint, uint64(node.EndSize))
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (c cborCodec) DecodeSum(r io.Reader, sum *thash.Sum) error {
+	return c.decodeSum(newByteReader(r), sum)
+}
+
+func (c cborCodec) EncodeSum(w io.Writer, sum thash.Sum) error {
+	var buf bytes.Buffer
+	if err := c.encodeSum(&buf, sum); err != nil {
+		return err
+	}
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (c cborCodec) DecodeBlobInfo(r io.Reader, info *merkle.BlobInfo) error {
+	*info = merkle.BlobInfo{}
+	err := c.decodeMap(r, func(br byteReader, key string) error {
+		var err error
+		switch key {
+		case "sum":
+			err = c.decodeSum(br, &info.Sum)
+		case "size":
+			info.Size, err = decodeSize(br)
+		default:
+			err = skip(br, 0)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := c.checkSum(info.Sum); err != nil {
+		return err
+	}
+	return c.checkBlobSize(info.Size)
+}
+
+func (c cborCodec) EncodeBlobInfo(w io.Writer, info merkle.BlobInfo) error {
+	var buf bytes.Buffer
+	writeHead(&buf, cborMap, 2)
+	writeText(&buf, "sum")
+	if err := c.encodeSum(&buf, info.Sum); err != nil {
+		return err
+	}
+	writeText(&buf, "size")
+	writeHead(&buf, cborUint, uint64(info.Size))
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+func (c cborCodec) DecodeBlob(r io.Reader, sum *thash.Sum, w io.Writer) error {
+	size, blob, err := c.DecodeBlobStream(r, sum)
+	if err != nil {
+		return err
+	}
+	return merkle.CopyBlob(w, blob, size)
+}
+
+func (c cborCodec) EncodeBlob(w io.Writer, sum thash.Sum, data []byte) error {
+	return c.EncodeBlobStream(w, sum, int64(len(data)), bytes.NewReader(data))
+}
+
+func (c cborCodec) DecodeBlobStream(r io.Reader, sum *thash.Sum) (int64, io.Reader, error) {
+	br := newByteReader(r)
+	major, n, err := readHead(br)
+	if err != nil {
+		return 0, nil, err
+	}
+	if major != cborMap {
+		return 0, nil, fmt.Errorf("expected a map, got major type %d", major)
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := decodeKey(br)
+		if err != nil {
+			return 0, nil, err
+		}
+		switch key {
+		case "sum":
+			err = c.decodeSum(br, sum)
+		case "data":
+			major, size, err := readHead(br)
+			if err != nil {
+				return 0, nil, err
+			}
+			if major != cborBytes {
+				return 0, nil, fmt.Errorf("expected blob data, got major type %d", major)
+			}
+			if size > 1<<62 {
+				return 0, nil, fmt.Errorf("size %d is too large", size)
+			}
+			if err := c.checkSum(*sum); err != nil {
+				return 0, nil, err
+			}
+			if err := c.checkBlobSize(int64(size)); err != nil {
+				return 0, nil, err
+			}
+			return int64(size), io.LimitReader(br, int64(size)), nil
+		default:
+			err = skip(br, 0)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return 0, nil, errors.New("blob has no data")
+}
+
+func (c cborCodec) EncodeBlobStream(w io.Writer, sum thash.Sum, size int64, r io.Reader) error {
+	var buf bytes.Buffer
+	writeHead(&buf, cborMap, 2)
+	writeText(&buf, "sum")
+	if err := c.encodeSum(&buf, sum); err != nil {
+		return err
+	}
+	writeText(&buf, "data")
+	writeHead(&buf, cborBytes, uint64(size))
+	if _, err := buf.WriteTo(w); err != nil {
+		return err
+	}
+	return merkle.CopyBlob(w, r, size)
+}
+
+func (cborCodec) decodeMap(r io.Reader, onKey func(br byteReader, key string) error) error {
+	br := newByteReader(r)
+	major, n, err := readHead(br)
+	if err != nil {
+		return err
+	}
+	if major != cborMap {
+		return fmt.Errorf("expected a map, got major type %d", major)
+	}
+	for i := uint64(0); i < n; i++ {
+		key, err := decodeKey(br)
+		if err != nil {
+			return err
+		}
+		if err := onKey(br, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sums are CIDs, in a byte string that starts with a 0, under tag 42
+func (c cborCodec) decodeSum(br byteReader, sum *thash.Sum) error {
+	major, tag, err := readHead(br)
+	if err != nil {
+		return err
+	}
+	if major != cborTag || tag != cborCIDTag {
+		return fmt.Errorf("expected a CID, got major type %d", major)
+	}
+	major, n, err := readHead(br)
+	if err != nil {
+		return err
+	}
+	if major != cborBytes || n < 1 || n > cborMaxCID {
+		return fmt.Errorf("expected the bytes of a CID, got major type %d of length %d", major, n)
+	}
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(br, buf); err != nil {
+		return err
+	}
+	if buf[0] != 0 {
+		return fmt.Errorf("CID should start with 0, not %d", buf[0])
+	}
+	if err := sum.UnmarshalBinary(buf[1:]); err != nil {
+		return err
+	}
+	return c.checkSum(*sum)
+}
+
+func (cborCodec) encodeSum(buf *bytes.Buffer, sum thash.Sum) error {
+	cid, err := sum.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	writeHead(buf, cborTag, cborCIDTag)
+	writeHead(buf, cborBytes, uint64(len(cid)+1))
+	buf.WriteByte(0)
+	buf.Write(cid)
+	return nil
+}
+
+func writeHead(buf *bytes.Buffer, major byte, n uint64) {
+	major <<= 5
+	switch {
+	case n < 24:
+		buf.WriteByte(major | byte(n))
+	case n <= 0xff:
+		buf.Write([]byte{major | 24, byte(n)})
+	case n <= 0xffff:
+		var b [3]byte
+		b[0] = major | 25
+		binary.BigEndian.PutUint16(b[1:], uint16(n))
+		buf.Write(b[:])
+	case n <= 0xffffffff:
+		var b [5]byte
+		b[0] = major | 26
+		binary.BigEndian.PutUint32(b[1:], uint32(n))
+		buf.Write(b[:])
+	default:
+		var b [9]byte
+		b[0] = major | 27
+		binary.BigEndian.PutUint64(b[1:], n)
+		buf.Write(b[:])
+	}
+}
+
+func writeText(buf *bytes.Buffer, s string) {
+	writeHead(buf, cborText, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// readHead reads the major type and argument of the next value.
+// Values of indefinite length aren't supported.
+func readHead(br byteReader) (major byte, n uint64, err error) {
+	b, err := br.ReadByte()
+	if err != nil {
+		return 0, 0, err
+	}
+	major, info := b>>5, b&0x1f
+	var size int
+	switch {
+	case info < 24:
+		return major, uint64(info), nil
+	case info == 24:
+		size = 1
+	case info == 25:
+		size = 2
+	case info == 26:
+		size = 4
+	case info == 27:
+		size = 8
+	default:
+		return 0, 0, fmt.Errorf("unsupported CBOR value %#x", b)
+	}
+	var buf [8]byte
+	if _, err := io.ReadFull(br, buf[8-size:]); err != nil {
+		return 0, 0, noEOF(err)
+	}
+	return major, binary.BigEndian.Uint64(buf[:]), nil
+}
+
+func decodeUint(br byteReader) (uint64, error) {
+	major, n, err := readHead(br)
+	if err != nil {
+		return 0, noEOF(err)
+	}
+	if major != cborUint {
+		return 0, fmt.Errorf("expected an unsigned integer, got major type %d", major)
+	}
+	return n, nil
+}
+
+func decodeKind(br byteReader) (uint64, error) {
+	n, err := decodeUint(br)
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(merkle.BlobChild) {
+		return 0, fmt.Errorf("unknown child kind %d", n)
+	}
+	return n, nil
+}
+
+func decodeSize(br byteReader) (int64, error) {
+	n, err := decodeUint(br)
+	if err != nil {
+		return 0, err
+	}
+	if n > 1<<62 {
+		return 0, fmt.Errorf("size %d is too large", n)
+	}
+	return int64(n), nil
+}
+
+// decodeKey reads a map key. Keys that aren't short strings can't be
+// any we know, and are returned empty.
+func decodeKey(br byteReader) (string, error) {
+	major, n, err := readHead(br)
+	if err != nil {
+		return "", noEOF(err)
+	}
+	if major != cborText || n > cborMaxKey {
+		return "", skipValue(br, major, n, 0)
+	}
+	key := make([]byte, n)
+	if _, err := io.ReadFull(br, key); err != nil {
+		return "", noEOF(err)
+	}
+	return string(key), nil
+}
+
+// skip reads over the next value.
+func skip(br byteReader, depth int) error {
+	major, n, err := readHead(br)
+	if err != nil {
+		return noEOF(err)
+	}
+	return skipValue(br, major, n, depth)
+}
+
+func skipValue(br byteReader, major byte, n uint64, depth int) error {
+	if depth > cborMaxDepth {
+		return errors.New("CBOR values are nested too deep")
+	}
+	switch major {
+	case cborUint, cborNint, cborOther:
+		return nil
+	case cborBytes, cborText:
+		if n > 1<<62 {
+			return fmt.Errorf("CBOR string of %d bytes is too large", n)
+		}
+		_, err := io.CopyN(ioutil.Discard, br, int64(n))
+		return noEOF(err)
+	case cborArray, cborMap:
+		if major == cborMap {
+			n *= 2
+		}
+		for i := uint64(0); i < n; i++ {
+			if err := skip(br, depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case cborTag:
+		return skip(br, depth+1)
+	}
+	return fmt.Errorf("unknown CBOR major type %d", major)
+}
+
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+type byteReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// newByteReader reads a byte at a time from readers that can't, so
+// that nothing past a value is consumed.
+func newByteReader(r io.Reader) byteReader {
+	if br, ok := r.(byteReader); ok {
+		return br
+	}
+	return &oneByteReader{r: r}
+}
+
+type oneByteReader struct {
+	r   io.Reader
+	buf [1]byte
+}
+
+func (obr *oneByteReader) Read(p []byte) (int, error) { return obr.r.Read(p) }
+
+func (obr *oneByteReader) ReadByte() (byte, error) {
+	_, err := io.ReadFull(obr.r, obr.buf[:])
+	return obr.buf[0], err
+}
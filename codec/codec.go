@@ -4,14 +4,17 @@ import (
 	"io"
 
 	"encoding/binary"
-
-	"bytes"
+	"fmt"
+	"mime"
 
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/epher/thash"
 )
 
 type Codec interface {
+	// ContentType is the media type of what the codec encodes.
+	ContentType() string
+
 	DecodeNode(io.Reader, *merkle.Node) error
 	EncodeNode(io.Writer, merkle.Node) error
 
@@ -21,51 +24,148 @@ type Codec interface {
 	DecodeBlob(io.Reader, *thash.Sum, io.Writer) error
 	EncodeBlob(io.Writer, thash.Sum, []byte) error
 
+	// DecodeBlobStream decodes the sum and size of a blob, returning
+	// a reader over the blob's content.
+	DecodeBlobStream(io.Reader, *thash.Sum) (int64, io.Reader, error)
+	// EncodeBlobStream encodes a blob of the given size, read from
+	// the reader.
+	EncodeBlobStream(io.Writer, thash.Sum, int64, io.Reader) error
+
 	DecodeBlobInfo(io.Reader, *merkle.BlobInfo) error
 	EncodeBlobInfo(io.Writer, merkle.BlobInfo) error
 }
 
-func Binary() Codec {
-	return bin{}
+// Binary encodes in a compact binary format, with little endian
+// integers and length prefixes. It's what nodes speak to each other.
+func Binary(opts ...Option) Codec {
+	return bin{limits: newLimits(opts)}
 }
 
-type bin struct{}
+// ByContentType finds the codec of a media type, ignoring parameters.
+func ByContentType(contentType string, opts ...Option) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return nil, false
+	}
+	for _, codec := range []Codec{Binary(opts...), JSON(opts...), CBOR(opts...)} {
+		if codec.ContentType() == mediaType {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+type bin struct {
+	limits
+}
+
+func (bin) ContentType() string { return "application/vnd.epher.binary" }
+
+// Nodes used to start with their sum. They now start with a marker
+// that can't be the type of a sum, followed by the version of their
+// encoding.
+const (
+	nodeMarker  = 0xffff
+	nodeVersion = 2
+)
 
 func (b bin) DecodeNode(r io.Reader, node *merkle.Node) error {
-	if err := b.DecodeSum(r, &node.Sum); err != nil {
+	var marker uint16
+	if err := binary.Read(r, binary.LittleEndian, &marker); err != nil {
 		return err
 	}
-	if err := b.DecodeSum(r, &node.Start); err != nil {
+	if marker != nodeMarker {
+		// nodes that don't describe their children
+		*node = merkle.Node{}
+		node.Sum.Type = thash.Type(marker)
+		if err := b.decodeSumBytes(r, &node.Sum); err != nil {
+			return err
+		}
+		if err := b.DecodeSum(r, &node.Start); err != nil {
+			return err
+		}
+		return b.DecodeSum(r, &node.End)
+	}
+
+	var version uint8
+	if err := binary.Read(r, binary.LittleEndian, &version); err != nil {
 		return err
 	}
-	if err := b.DecodeSum(r, &node.End); err != nil {
+	if version != nodeVersion {
+		return fmt.Errorf("unknown node encoding version %d", version)
+	}
+	if err := b.DecodeSum(r, &node.Sum); err != nil {
 		return err
 	}
-	return nil
+	if err := b.decodeChild(r, &node.Start, &node.StartKind, &node.StartSize); err != nil {
+		return err
+	}
+	return b.decodeChild(r, &node.End, &node.EndKind, &node.EndSize)
 }
 
 func (b bin) EncodeNode(w io.Writer, node merkle.Node) error {
+	if err := binary.Write(w, binary.LittleEndian, uint16(nodeMarker)); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint8(nodeVersion)); err != nil {
+		return err
+	}
 	if err := b.EncodeSum(w, node.Sum); err != nil {
 		return err
 	}
-	if err := b.EncodeSum(w, node.Start); err != nil {
+	if err := b.encodeChild(w, node.Start, node.StartKind, node.StartSize); err != nil {
+		return err
+	}
+	return b.encodeChild(w, node.End, node.EndKind, node.EndSize)
+}
+
+func (b bin) decodeChild(r io.Reader, sum *thash.Sum, kind *merkle.ChildKind, size *int64) error {
+	if err := b.DecodeSum(r, sum); err != nil {
 		return err
 	}
-	if err := b.EncodeSum(w, node.End); err != nil {
+	if err := binary.Read(r, binary.LittleEndian, kind); err != nil {
 		return err
 	}
-	return nil
+	if err := binary.Read(r, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	return checkChild(*kind, *size)
+}
+
+func (b bin) encodeChild(w io.Writer, sum thash.Sum, kind merkle.ChildKind, size int64) error {
+	if err := b.EncodeSum(w, sum); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, kind); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, size)
 }
 
 func (b bin) DecodeSum(r io.Reader, sum *thash.Sum) error {
 	if err := binary.Read(r, binary.LittleEndian, &sum.Type); err != nil {
 		return err
 	}
-	buf := bytes.NewBuffer(nil)
-	if err := b.decodeBytes(r, buf); err != nil {
+	return b.decodeSumBytes(r, sum)
+}
+
+func (b bin) decodeSumBytes(r io.Reader, sum *thash.Sum) error {
+	want, err := b.sumSize(sum.Type)
+	if err != nil {
+		return err
+	}
+	var l int64
+	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return err
+	}
+	if l != int64(want) {
+		return &SumSizeError{Type: sum.Type, Size: l, Want: want}
+	}
+	buf := make([]byte, l)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return err
 	}
-	sum.Sum = buf.String()
+	sum.Sum = string(buf)
 	return nil
 }
 
@@ -83,9 +183,11 @@ func (b bin) DecodeBlobInfo(r io.Reader, info *merkle.BlobInfo) error {
 	if err := b.DecodeSum(r, &info.Sum); err != nil {
 		return err
 	}
-	if err := binary.Read(r, binary.LittleEndian, &info.Size); err != nil {
+	size, err := b.decodeLength(r)
+	if err != nil {
 		return err
 	}
+	info.Size = size
 	return nil
 }
 
@@ -119,9 +221,42 @@ func (b bin) EncodeBlob(w io.Writer, sum thash.Sum, data []byte) error {
 	return nil
 }
 
-func (bin) decodeBytes(r io.Reader, w io.Writer) error {
+func (b bin) DecodeBlobStream(r io.Reader, sum *thash.Sum) (int64, io.Reader, error) {
+	if err := b.DecodeSum(r, sum); err != nil {
+		return 0, nil, err
+	}
+	l, err := b.decodeLength(r)
+	if err != nil {
+		return 0, nil, err
+	}
+	return l, io.LimitReader(r, l), nil
+}
+
+func (b bin) EncodeBlobStream(w io.Writer, sum thash.Sum, size int64, r io.Reader) error {
+	if err := b.EncodeSum(w, sum); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	return merkle.CopyBlob(w, r, size)
+}
+
+// decodeLength decodes the size of a blob.
+func (b bin) decodeLength(r io.Reader) (int64, error) {
 	var l int64
 	if err := binary.Read(r, binary.LittleEndian, &l); err != nil {
+		return 0, err
+	}
+	if err := b.checkBlobSize(l); err != nil {
+		return 0, err
+	}
+	return l, nil
+}
+
+func (b bin) decodeBytes(r io.Reader, w io.Writer) error {
+	l, err := b.decodeLength(r)
+	if err != nil {
 		return err
 	}
 	n, err := io.CopyN(w, r, l)
@@ -2,18 +2,263 @@ package codec
 
 import (
 	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
 	"testing"
 
 	"reflect"
+	"strings"
 
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/epher/thash"
 )
 
 func TestBinary(t *testing.T) { testCodec(t, Binary()) }
+func TestJSON(t *testing.T)   { testCodec(t, JSON()) }
+func TestCBOR(t *testing.T)   { testCodec(t, CBOR()) }
+
+func TestBinaryLegacyNode(t *testing.T) {
+	tree, _ := makeBlob([]byte("tree"))
+	start, _ := makeBlob([]byte("start"))
+	end, _ := makeBlob([]byte("end"))
+
+	// nodes used to be their three sums
+	codec := Binary()
+	buf := bytes.NewBuffer(nil)
+	for _, sum := range []thash.Sum{tree, start, end} {
+		if err := codec.EncodeSum(buf, sum); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := merkle.Node{Sum: tree, Start: start, End: end}
+	var got merkle.Node
+	if err := codec.DecodeNode(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(want, got) {
+		t.Errorf("want=%v", want)
+		t.Errorf(" got=%v", got)
+	}
+	if got.Described() {
+		t.Errorf("legacy node shouldn't be described")
+	}
+}
+
+func TestByContentType(t *testing.T) {
+	for _, want := range []Codec{Binary(), JSON(), CBOR()} {
+		got, ok := ByContentType(want.ContentType() + "; charset=utf-8")
+		if !ok || got.ContentType() != want.ContentType() {
+			t.Errorf("want %q, got %v", want.ContentType(), got)
+		}
+	}
+	if _, ok := ByContentType("text/plain"); ok {
+		t.Errorf("text/plain isn't a codec")
+	}
+}
+
+func TestJSONBlobStream(t *testing.T) {
+	sum, _ := makeBlob([]byte("hello world"))
+	text := sum.String()
+
+	// written by hand, with other keys and spaces
+	doc := `{ "other": {"a": [1, 2]}, "sum" : "` + text + `", "size": 11 ,
+		"data" :  "aGVsbG8gd29ybGQ=" }`
+	var gotSum thash.Sum
+	size, r, err := JSON().DecodeBlobStream(strings.NewReader(doc), &gotSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotSum != sum || size != 11 || string(got) != "hello world" {
+		t.Errorf("got sum=%v size=%d data=%q", gotSum, size, got)
+	}
+
+	doc = `{"data": "aGVsbG8gd29ybGQ=", "sum": "` + text + `", "size": 11}`
+	if _, _, err := JSON().DecodeBlobStream(strings.NewReader(doc), &gotSum); err == nil {
+		t.Errorf("data before the size should be an error")
+	}
+
+	// sums are readable
+	buf := bytes.NewBuffer(nil)
+	if err := JSON().EncodeSum(buf, sum); err != nil {
+		t.Fatal(err)
+	}
+	if want := `"` + text + `"` + "\n"; buf.String() != want {
+		t.Errorf("want %q, got %q", want, buf.String())
+	}
+}
+
+func TestBinaryLimits(t *testing.T) {
+	sum, data := makeBlob([]byte("hello world"))
+
+	encode := func(typ uint16, values ...int64) *bytes.Buffer {
+		buf := bytes.NewBuffer(nil)
+		_ = binary.Write(buf, binary.LittleEndian, typ)
+		for _, v := range values {
+			_ = binary.Write(buf, binary.LittleEndian, v)
+		}
+		return buf
+	}
+
+	var got thash.Sum
+	err := Binary().DecodeSum(encode(42, 1<<40), &got)
+	if want := (&UnknownTypeError{Type: 42}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	err = Binary().DecodeSum(encode(uint16(thash.SHA256), 1<<40), &got)
+	if want := (&SumSizeError{Type: thash.SHA256, Size: 1 << 40, Want: 32}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	custom := Binary(WithSumSize(42, 3))
+	if err := custom.DecodeSum(bytes.NewBufferString("\x2a\x00\x03\x00\x00\x00\x00\x00\x00\x00abc"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (thash.Sum{Type: 42, Sum: "abc"}); got != want {
+		t.Errorf("want=%v", want)
+		t.Errorf(" got=%v", got)
+	}
+
+	for _, size := range []int64{-1, 1 << 62} {
+		buf := bytes.NewBuffer(nil)
+		if err := Binary().EncodeSum(buf, sum); err != nil {
+			t.Fatal(err)
+		}
+		_ = binary.Write(buf, binary.LittleEndian, size)
+		_, _, err := Binary().DecodeBlobStream(buf, &got)
+		if want := (&BlobSizeError{Size: size, Max: DefaultMaxBlobSize}); !reflect.DeepEqual(want, err) {
+			t.Errorf("want %v, got %v", want, err)
+		}
+	}
+
+	buf := bytes.NewBuffer(nil)
+	if err := Binary().EncodeBlob(buf, sum, data); err != nil {
+		t.Fatal(err)
+	}
+	err = Binary(WithMaxBlobSize(4)).DecodeBlob(buf, &got, ioutil.Discard)
+	if want := (&BlobSizeError{Size: int64(len(data)), Max: 4}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+func TestJSONLimits(t *testing.T) {
+	var sum thash.Sum
+	err := JSON().DecodeSum(strings.NewReader(`"42:00"`), &sum)
+	if want := (&UnknownTypeError{Type: 42}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	err = JSON().DecodeSum(strings.NewReader(`"3:0011"`), &sum)
+	if want := (&SumSizeError{Type: thash.SHA256, Size: 2, Want: 32}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	blob, data := makeBlob([]byte("hello world"))
+	buf := bytes.NewBuffer(nil)
+	if err := JSON().EncodeBlob(buf, blob, data); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = JSON(WithMaxBlobSize(4)).DecodeBlobStream(buf, &sum)
+	if want := (&BlobSizeError{Size: int64(len(data)), Max: 4}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+	err = JSON().DecodeBlobInfo(strings.NewReader(`{"sum":"`+blob.String()+`","size":-1}`), new(merkle.BlobInfo))
+	if want := (&BlobSizeError{Size: -1, Max: DefaultMaxBlobSize}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+}
+
+func TestCBORLimits(t *testing.T) {
+	blob, data := makeBlob([]byte("hello world"))
+	var sum thash.Sum
+
+	buf := bytes.NewBuffer(nil)
+	if err := CBOR().EncodeBlob(buf, blob, data); err != nil {
+		t.Fatal(err)
+	}
+	_, _, err := CBOR(WithMaxBlobSize(4)).DecodeBlobStream(buf, &sum)
+	if want := (&BlobSizeError{Size: int64(len(data)), Max: 4}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	buf.Reset()
+	if err := CBOR().EncodeBlobInfo(buf, merkle.BlobInfo{Sum: blob, Size: 1 << 40}); err != nil {
+		t.Fatal(err)
+	}
+	err = CBOR().DecodeBlobInfo(buf, new(merkle.BlobInfo))
+	if want := (&BlobSizeError{Size: 1 << 40, Max: DefaultMaxBlobSize}); !reflect.DeepEqual(want, err) {
+		t.Errorf("want %v, got %v", want, err)
+	}
+
+	// the size of the data can't pass for a negative int64
+	buf.Reset()
+	writeHead(buf, cborMap, 2)
+	writeText(buf, "sum")
+	if err := (cborCodec{}).encodeSum(buf, blob); err != nil {
+		t.Fatal(err)
+	}
+	writeText(buf, "data")
+	writeHead(buf, cborBytes, 1<<63)
+	if _, _, err := CBOR().DecodeBlobStream(buf, &sum); err == nil {
+		t.Errorf("decoded a blob of 1<<63 bytes")
+	}
+}
+
+func TestNegotiateKeepsLimits(t *testing.T) {
+	own := Binary(WithMaxBlobSize(4))
+	for _, ct := range []string{"application/vnd.epher.binary", "application/json", "application/cbor"} {
+		cd, ok := Negotiate(own, ct)
+		if !ok {
+			t.Fatalf("no codec for %q", ct)
+		}
+		if got := MaxBlobSize(cd); got != 4 {
+			t.Errorf("%s: max blob size is %d", ct, got)
+		}
+	}
+	if cd, _ := Negotiate(own, own.ContentType()+"; q=1"); !reflect.DeepEqual(cd, own) {
+		t.Errorf("didn't negotiate the codec itself")
+	}
+}
+
+func TestCBORSkipsUnknownKeys(t *testing.T) {
+	sum, _ := makeBlob([]byte("hello world"))
+
+	buf := bytes.NewBuffer(nil)
+	writeHead(buf, cborMap, 3)
+	writeText(buf, "other")
+	writeHead(buf, cborArray, 2)
+	writeHead(buf, cborMap, 1)
+	writeText(buf, "nested")
+	writeHead(buf, cborBytes, 3)
+	buf.WriteString("abc")
+	writeHead(buf, cborNint, 1000)
+	writeText(buf, "sum")
+	if err := (cborCodec{}).encodeSum(buf, sum); err != nil {
+		t.Fatal(err)
+	}
+	writeText(buf, "size")
+	writeHead(buf, cborUint, 11)
+	buf.WriteString("trailing")
+
+	var got merkle.BlobInfo
+	if err := CBOR().DecodeBlobInfo(buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if want := (merkle.BlobInfo{Sum: sum, Size: 11}); got != want {
+		t.Errorf("want=%v", want)
+		t.Errorf(" got=%v", got)
+	}
+	if buf.String() != "trailing" {
+		t.Errorf("read past the value: %q left", buf.String())
+	}
+}
 
 func makeBlob(data []byte) (thash.Sum, []byte) {
-	h := thash.New(thash.Blake2B512)
+	h, _ := thash.New(thash.Blake2B512)
 	h.Write(data)
 	return thash.MakeSum(h), data
 }
@@ -25,7 +270,15 @@ func testCodec(t *testing.T, codec Codec) {
 		start, _ := makeBlob([]byte("start"))
 		end, _ := makeBlob([]byte("end"))
 
-		want := merkle.Node{Sum: tree, Start: start, End: end}
+		want := merkle.Node{
+			Sum:       tree,
+			Start:     start,
+			End:       end,
+			StartKind: merkle.NodeChild,
+			EndKind:   merkle.BlobChild,
+			StartSize: 8 << 20,
+			EndSize:   42,
+		}
 
 		buf := bytes.NewBuffer(nil)
 		if err := codec.EncodeNode(buf, want); err != nil {
@@ -62,6 +315,33 @@ func testCodec(t *testing.T, codec Codec) {
 		}
 	})
 
+	t.Run("codec sum types", func(t *testing.T) {
+		types := []thash.Type{
+			thash.Blake2B512,
+			thash.SHA3,
+			thash.SHA256,
+			thash.Blake2B256,
+			thash.Blake3,
+			thash.Blake2B256 | thash.Keyed | thash.DomainSeparated,
+		}
+		for _, typ := range types {
+			want := thash.Sum{Type: typ, Sum: string(make([]byte, typ.Size()))}
+
+			buf := bytes.NewBuffer(nil)
+			if err := codec.EncodeSum(buf, want); err != nil {
+				t.Fatal(err)
+			}
+			var got thash.Sum
+			if err := codec.DecodeSum(buf, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(want, got) {
+				t.Errorf("want=%v", want)
+				t.Errorf(" got=%v", got)
+			}
+		}
+	})
+
 	t.Run("codec blob", func(t *testing.T) {
 		wantSum, wantBlob := makeBlob([]byte("hello world"))
 		buf := bytes.NewBuffer(nil)
@@ -88,6 +368,45 @@ func testCodec(t *testing.T, codec Codec) {
 		}
 	})
 
+	t.Run("codec blob stream", func(t *testing.T) {
+		wantSum, wantBlob := makeBlob([]byte("hello world"))
+		buf := bytes.NewBuffer(nil)
+		err := codec.EncodeBlobStream(buf, wantSum, int64(len(wantBlob)), bytes.NewReader(wantBlob))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var gotSum thash.Sum
+		size, r, err := codec.DecodeBlobStream(buf, &gotSum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gotBlob, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(wantSum, gotSum) {
+			t.Errorf("want sum=%v", wantSum)
+			t.Errorf(" got sum=%v", gotSum)
+		}
+		if size != int64(len(wantBlob)) {
+			t.Errorf("want size=%d", len(wantBlob))
+			t.Errorf(" got size=%d", size)
+		}
+		if !reflect.DeepEqual(wantBlob, gotBlob) {
+			t.Errorf("want blob=%v", wantBlob)
+			t.Errorf(" got blob=%v", gotBlob)
+		}
+	})
+
+	t.Run("codec blob stream too short", func(t *testing.T) {
+		sum, blob := makeBlob([]byte("hello world"))
+		err := codec.EncodeBlobStream(ioutil.Discard, sum, int64(len(blob))+1, bytes.NewReader(blob))
+		if err != io.ErrUnexpectedEOF {
+			t.Fatalf("want %v, got %v", io.ErrUnexpectedEOF, err)
+		}
+	})
+
 	t.Run("codec blob info", func(t *testing.T) {
 		sum, blob := makeBlob([]byte("hello world"))
 		want := merkle.BlobInfo{
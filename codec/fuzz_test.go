@@ -0,0 +1,188 @@
+package codec
+
+import (
+	"bytes"
+	"io/ioutil"
+	"reflect"
+	"testing"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// The fuzz tests decode arbitrary bytes with every codec, under a small
+// blob limit. They check that decoding doesn't panic nor read more than
+// the limit, and that whatever decodes encodes back to the same value.
+
+const fuzzMaxBlobSize = 1 << 10
+
+func fuzzCodecs() []Codec {
+	return []Codec{
+		Binary(WithMaxBlobSize(fuzzMaxBlobSize)),
+		JSON(WithMaxBlobSize(fuzzMaxBlobSize)),
+		CBOR(WithMaxBlobSize(fuzzMaxBlobSize)),
+	}
+}
+
+func fuzzSeeds(f *testing.F, encode func(cd Codec, buf *bytes.Buffer) error) {
+	for _, cd := range fuzzCodecs() {
+		buf := bytes.NewBuffer(nil)
+		if err := encode(cd, buf); err != nil {
+			f.Fatal(err)
+		}
+		f.Add(buf.Bytes())
+		f.Add(buf.Bytes()[:buf.Len()/2])
+	}
+	f.Add([]byte{})
+	f.Add([]byte{0xff, 0xff, 0x02, 0x01, 0x00, 0x40})
+	f.Add([]byte(`{"sum":"1:00","size":4294967296,"data":"`))
+	f.Add([]byte{0xa1, 0x64, 'd', 'a', 't', 'a', 0x5b, 0x3f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+}
+
+func FuzzDecodeNode(f *testing.F) {
+	tree, _ := makeBlob([]byte("tree"))
+	start, _ := makeBlob([]byte("start"))
+	end, _ := makeBlob([]byte("end"))
+	fuzzSeeds(f, func(cd Codec, buf *bytes.Buffer) error {
+		return cd.EncodeNode(buf, merkle.Node{
+			Sum: tree, Start: start, End: end,
+			StartKind: merkle.BlobChild, EndKind: merkle.BlobChild,
+			StartSize: 5, EndSize: 3,
+		})
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, cd := range fuzzCodecs() {
+			var node merkle.Node
+			if err := cd.DecodeNode(bytes.NewReader(data), &node); err != nil {
+				continue
+			}
+			buf := bytes.NewBuffer(nil)
+			if err := cd.EncodeNode(buf, node); err != nil {
+				t.Fatal(err)
+			}
+			var got merkle.Node
+			if err := cd.DecodeNode(buf, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(node, got) {
+				t.Errorf("%s: want=%v", cd.ContentType(), node)
+				t.Errorf("%s:  got=%v", cd.ContentType(), got)
+			}
+		}
+	})
+}
+
+func FuzzDecodeSum(f *testing.F) {
+	sum, _ := makeBlob([]byte("sum"))
+	fuzzSeeds(f, func(cd Codec, buf *bytes.Buffer) error {
+		return cd.EncodeSum(buf, sum)
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, cd := range fuzzCodecs() {
+			var sum thash.Sum
+			if err := cd.DecodeSum(bytes.NewReader(data), &sum); err != nil {
+				continue
+			}
+			if len(sum.Sum) != sum.Type.Size() {
+				t.Errorf("%s: decoded a %d bytes sum of type %v", cd.ContentType(), len(sum.Sum), sum.Type)
+			}
+			buf := bytes.NewBuffer(nil)
+			if err := cd.EncodeSum(buf, sum); err != nil {
+				t.Fatal(err)
+			}
+			var got thash.Sum
+			if err := cd.DecodeSum(buf, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != sum {
+				t.Errorf("%s: want=%v", cd.ContentType(), sum)
+				t.Errorf("%s:  got=%v", cd.ContentType(), got)
+			}
+		}
+	})
+}
+
+func FuzzDecodeBlobInfo(f *testing.F) {
+	sum, _ := makeBlob([]byte("info"))
+	fuzzSeeds(f, func(cd Codec, buf *bytes.Buffer) error {
+		return cd.EncodeBlobInfo(buf, merkle.BlobInfo{Sum: sum, Size: 4})
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, cd := range fuzzCodecs() {
+			var info merkle.BlobInfo
+			if err := cd.DecodeBlobInfo(bytes.NewReader(data), &info); err != nil {
+				continue
+			}
+			if info.Size < 0 || info.Size > fuzzMaxBlobSize {
+				t.Errorf("%s: decoded a blob of %d bytes", cd.ContentType(), info.Size)
+			}
+			buf := bytes.NewBuffer(nil)
+			if err := cd.EncodeBlobInfo(buf, info); err != nil {
+				t.Fatal(err)
+			}
+			var got merkle.BlobInfo
+			if err := cd.DecodeBlobInfo(buf, &got); err != nil {
+				t.Fatal(err)
+			}
+			if got != info {
+				t.Errorf("%s: want=%v", cd.ContentType(), info)
+				t.Errorf("%s:  got=%v", cd.ContentType(), got)
+			}
+		}
+	})
+}
+
+func FuzzDecodeBlob(f *testing.F) {
+	sum, blob := makeBlob([]byte("blob"))
+	fuzzSeeds(f, func(cd Codec, buf *bytes.Buffer) error {
+		return cd.EncodeBlob(buf, sum, blob)
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, cd := range fuzzCodecs() {
+			var sum thash.Sum
+			blob := bytes.NewBuffer(nil)
+			if err := cd.DecodeBlob(bytes.NewReader(data), &sum, blob); err != nil {
+				if blob.Len() > fuzzMaxBlobSize {
+					t.Errorf("%s: read %d bytes of a blob", cd.ContentType(), blob.Len())
+				}
+				continue
+			}
+			buf := bytes.NewBuffer(nil)
+			if err := cd.EncodeBlob(buf, sum, blob.Bytes()); err != nil {
+				t.Fatal(err)
+			}
+			var gotSum thash.Sum
+			got := bytes.NewBuffer(nil)
+			if err := cd.DecodeBlob(buf, &gotSum, got); err != nil {
+				t.Fatal(err)
+			}
+			if gotSum != sum || !bytes.Equal(got.Bytes(), blob.Bytes()) {
+				t.Errorf("%s: want=%v %q", cd.ContentType(), sum, blob.Bytes())
+				t.Errorf("%s:  got=%v %q", cd.ContentType(), gotSum, got.Bytes())
+			}
+		}
+	})
+}
+
+func FuzzDecodeBlobStream(f *testing.F) {
+	sum, blob := makeBlob([]byte("stream"))
+	fuzzSeeds(f, func(cd Codec, buf *bytes.Buffer) error {
+		return cd.EncodeBlobStream(buf, sum, int64(len(blob)), bytes.NewReader(blob))
+	})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		for _, cd := range fuzzCodecs() {
+			var sum thash.Sum
+			size, r, err := cd.DecodeBlobStream(bytes.NewReader(data), &sum)
+			if err != nil {
+				continue
+			}
+			if size < 0 || size > fuzzMaxBlobSize {
+				t.Errorf("%s: decoded a blob of %d bytes", cd.ContentType(), size)
+			}
+			blob, _ := ioutil.ReadAll(r)
+			if int64(len(blob)) > size {
+				t.Errorf("%s: read %d bytes of a blob of %d bytes", cd.ContentType(), len(blob), size)
+			}
+		}
+	})
+}
@@ -0,0 +1,236 @@
+package codec
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// JSON encodes in JSON, with sums in their text form. It's meant for
+// debugging and for browser clients. Blobs are objects whose data is
+// in base64, and must come after their sum and size.
+func JSON(opts ...Option) Codec {
+	return jsonCodec{limits: newLimits(opts)}
+}
+
+type jsonCodec struct {
+	limits
+}
+
+// jsonMaxDoc bounds the documents of nodes, sums and infos, and what
+// comes before the data of a blob.
+const jsonMaxDoc = 64 << 10
+
+type jsonNode struct {
+	Sum       thash.Sum        `json:"sum"`
+	Start     thash.Sum        `json:"start"`
+	End       thash.Sum        `json:"end"`
+	StartKind merkle.ChildKind `json:"start_kind,omitempty"`
+	EndKind   merkle.ChildKind `json:"end_kind,omitempty"`
+	StartSize int64            `json:"start_size,omitempty"`
+	EndSize   int64            `json:"end_size,omitempty"`
+}
+
+type jsonBlobInfo struct {
+	Sum  thash.Sum `json:"sum"`
+	Size int64     `json:"size"`
+}
+
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (j jsonCodec) DecodeNode(r io.Reader, node *merkle.Node) error {
+	var jn jsonNode
+	if err := json.NewDecoder(io.LimitReader(r, jsonMaxDoc)).Decode(&jn); err != nil {
+		return err
+	}
+	if err := j.checkNode(merkle.Node(jn)); err != nil {
+		return err
+	}
+	*node = merkle.Node(jn)
+	return nil
+}
+
+func (jsonCodec) EncodeNode(w io.Writer, node merkle.Node) error {
+	return json.NewEncoder(w).Encode(jsonNode(node))
+}
+
+func (j jsonCodec) DecodeSum(r io.Reader, sum *thash.Sum) error {
+	if err := json.NewDecoder(io.LimitReader(r, jsonMaxDoc)).Decode(sum); err != nil {
+		return err
+	}
+	return j.checkSum(*sum)
+}
+
+func (jsonCodec) EncodeSum(w io.Writer, sum thash.Sum) error {
+	return json.NewEncoder(w).Encode(sum)
+}
+
+func (j jsonCodec) DecodeBlobInfo(r io.Reader, info *merkle.BlobInfo) error {
+	var ji jsonBlobInfo
+	if err := json.NewDecoder(io.LimitReader(r, jsonMaxDoc)).Decode(&ji); err != nil {
+		return err
+	}
+	if err := j.checkSum(ji.Sum); err != nil {
+		return err
+	}
+	if err := j.checkBlobSize(ji.Size); err != nil {
+		return err
+	}
+	*info = merkle.BlobInfo(ji)
+	return nil
+}
+
+func (jsonCodec) EncodeBlobInfo(w io.Writer, info merkle.BlobInfo) error {
+	return json.NewEncoder(w).Encode(jsonBlobInfo(info))
+}
+
+func (j jsonCodec) DecodeBlob(r io.Reader, sum *thash.Sum, w io.Writer) error {
+	size, blob, err := j.DecodeBlobStream(r, sum)
+	if err != nil {
+		return err
+	}
+	return merkle.CopyBlob(w, blob, size)
+}
+
+func (j jsonCodec) EncodeBlob(w io.Writer, sum thash.Sum, data []byte) error {
+	return j.EncodeBlobStream(w, sum, int64(len(data)), bytes.NewReader(data))
+}
+
+func (j jsonCodec) DecodeBlobStream(r io.Reader, sum *thash.Sum) (int64, io.Reader, error) {
+	dec := json.NewDecoder(io.LimitReader(r, jsonMaxDoc))
+	if err := expectDelim(dec, '{'); err != nil {
+		return 0, nil, err
+	}
+	size := int64(-1)
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch tok {
+		case "sum":
+			err = dec.Decode(sum)
+		case "size":
+			err = dec.Decode(&size)
+			if err == nil && size < 0 {
+				err = &BlobSizeError{Size: size, Max: j.maxBlobSize}
+			}
+		case "data":
+			if size < 0 {
+				return 0, nil, errors.New("blob data comes before its size")
+			}
+			if err := j.checkSum(*sum); err != nil {
+				return 0, nil, err
+			}
+			if err := j.checkBlobSize(size); err != nil {
+				return 0, nil, err
+			}
+			// stream the data rather than decoding it whole
+			data := &jsonString{r: bufio.NewReader(io.MultiReader(dec.Buffered(), r))}
+			if err := data.open(); err != nil {
+				return 0, nil, err
+			}
+			return size, io.LimitReader(base64.NewDecoder(base64.StdEncoding, data), size), nil
+		default:
+			err = dec.Decode(new(json.RawMessage))
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+	}
+	return 0, nil, errors.New("blob has no data")
+}
+
+func (jsonCodec) EncodeBlobStream(w io.Writer, sum thash.Sum, size int64, r io.Reader) error {
+	jsum, err := json.Marshal(sum)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, `{"sum":%s,"size":%d,"data":"`, jsum, size); err != nil {
+		return err
+	}
+	enc := base64.NewEncoder(base64.StdEncoding, w)
+	if err := merkle.CopyBlob(enc, r, size); err != nil {
+		return err
+	}
+	if err := enc.Close(); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\"}\n")
+	return err
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != delim {
+		return fmt.Errorf("expected %v, got %v", delim, tok)
+	}
+	return nil
+}
+
+// jsonString reads the content of a string value that follows an object
+// key, up to its closing quote. Base64 never needs to be escaped.
+type jsonString struct {
+	r    *bufio.Reader
+	done bool
+}
+
+// open skips the colon after the key and the opening quote.
+func (js *jsonString) open() error {
+	colon := false
+	for {
+		c, err := js.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		case c == ':' && !colon:
+			colon = true
+		case c == '"':
+			return nil
+		default:
+			return fmt.Errorf("expected a string, got %q", c)
+		}
+	}
+}
+
+func (js *jsonString) Read(p []byte) (int, error) {
+	if js.done {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) {
+		c, err := js.r.ReadByte()
+		if err == io.EOF {
+			return n, io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return n, err
+		}
+		if c == '"' {
+			js.done = true
+			break
+		}
+		p[n] = c
+		n++
+		if js.r.Buffered() == 0 {
+			// don't wait for more than what's there
+			break
+		}
+	}
+	if n == 0 && js.done {
+		return 0, io.EOF
+	}
+	return n, nil
+}
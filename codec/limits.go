@@ -0,0 +1,166 @@
+package codec
+
+import (
+	"fmt"
+	"mime"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// DefaultMaxBlobSize is the size of the largest blob a codec decodes,
+// unless told otherwise.
+const DefaultMaxBlobSize = 64 << 20
+
+// Option changes the limits of a codec. Sizes are read from the wire,
+// so codecs bound what they decode: sums must be of a known type and of
+// the size of its digests, and blobs can't be larger than
+// DefaultMaxBlobSize.
+type Option func(*limits)
+
+// WithMaxBlobSize sets the size of the largest blob a codec decodes.
+func WithMaxBlobSize(size int64) Option {
+	return func(l *limits) { l.maxBlobSize = size }
+}
+
+// WithSumSize sets the size of the sums of type t, when it differs from
+// the size of the digests of t. The binary codec decodes sums of a type
+// it doesn't know if given their size.
+func WithSumSize(t thash.Type, size int) Option {
+	return func(l *limits) {
+		sizes := make(map[thash.Type]int, len(l.sumSizes)+1)
+		for t, size := range l.sumSizes {
+			sizes[t] = size
+		}
+		sizes[t] = size
+		l.sumSizes = sizes
+	}
+}
+
+// UnknownTypeError is returned when decoding a sum of a type that
+// isn't known.
+type UnknownTypeError struct {
+	Type thash.Type
+}
+
+func (err *UnknownTypeError) Error() string {
+	return fmt.Sprintf("unknown hash type %v", err.Type)
+}
+
+// SumSizeError is returned when decoding a sum that isn't of the size
+// of its type.
+type SumSizeError struct {
+	Type thash.Type
+	Size int64
+	Want int
+}
+
+func (err *SumSizeError) Error() string {
+	return fmt.Sprintf("sums of type %v are %d bytes, not %d", err.Type, err.Want, err.Size)
+}
+
+// BlobSizeError is returned when decoding a blob that is larger than
+// allowed, or of a negative size.
+type BlobSizeError struct {
+	Size int64
+	Max  int64
+}
+
+func (err *BlobSizeError) Error() string {
+	if err.Size < 0 {
+		return fmt.Sprintf("invalid blob size %d", err.Size)
+	}
+	return fmt.Sprintf("blob of %d bytes is larger than %d bytes", err.Size, err.Max)
+}
+
+// Negotiate finds the codec of a media type, like ByContentType, with
+// the same limits as cd. It's cd itself if cd is of that media type.
+func Negotiate(cd Codec, contentType string) (Codec, bool) {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err == nil && mediaType == cd.ContentType() {
+		return cd, true
+	}
+	return ByContentType(contentType, limitsOf(cd).options()...)
+}
+
+// MaxBlobSize is the size of the largest blob cd decodes.
+func MaxBlobSize(cd Codec) int64 {
+	return limitsOf(cd).maxBlobSize
+}
+
+type limits struct {
+	maxBlobSize int64
+	sumSizes    map[thash.Type]int // overrides the size of digests
+}
+
+func newLimits(opts []Option) limits {
+	l := limits{maxBlobSize: DefaultMaxBlobSize}
+	for _, opt := range opts {
+		opt(&l)
+	}
+	return l
+}
+
+// limitsOf the codecs of this package, and the defaults for others.
+func limitsOf(cd Codec) limits {
+	if limited, ok := cd.(interface{ codecLimits() limits }); ok {
+		return limited.codecLimits()
+	}
+	return newLimits(nil)
+}
+
+func (l limits) codecLimits() limits { return l }
+
+func (l limits) options() []Option {
+	return []Option{func(to *limits) { *to = l }}
+}
+
+func (l limits) sumSize(t thash.Type) (int, error) {
+	if size, ok := l.sumSizes[t]; ok {
+		return size, nil
+	}
+	if size := t.Size(); size != 0 {
+		return size, nil
+	}
+	return 0, &UnknownTypeError{Type: t}
+}
+
+func (l limits) checkSum(sum thash.Sum) error {
+	want, err := l.sumSize(sum.Type)
+	if err != nil {
+		return err
+	}
+	if len(sum.Sum) != want {
+		return &SumSizeError{Type: sum.Type, Size: int64(len(sum.Sum)), Want: want}
+	}
+	return nil
+}
+
+func (l limits) checkBlobSize(size int64) error {
+	if size < 0 || size > l.maxBlobSize {
+		return &BlobSizeError{Size: size, Max: l.maxBlobSize}
+	}
+	return nil
+}
+
+func (l limits) checkNode(node merkle.Node) error {
+	for _, sum := range []thash.Sum{node.Sum, node.Start, node.End} {
+		if err := l.checkSum(sum); err != nil {
+			return err
+		}
+	}
+	if err := checkChild(node.StartKind, node.StartSize); err != nil {
+		return err
+	}
+	return checkChild(node.EndKind, node.EndSize)
+}
+
+func checkChild(kind merkle.ChildKind, size int64) error {
+	if kind > merkle.BlobChild {
+		return fmt.Errorf("unknown child kind %d", kind)
+	}
+	if size < 0 {
+		return fmt.Errorf("invalid child size %d", size)
+	}
+	return nil
+}
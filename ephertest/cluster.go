@@ -18,6 +18,8 @@ func ServiceDiscovery(t *testing.T) cluster.Discovery {
 type memDiscovery struct {
 	membersMu sync.Mutex
 	members   map[cluster.Node]struct{}
+
+	watchers cluster.Watchers
 }
 
 func (mem *memDiscovery) Discover(addr ...string) (cluster.RemoteCluster, error) {
@@ -29,6 +31,7 @@ func (mem *memDiscovery) join(self cluster.Node) error {
 	mem.membersMu.Lock()
 	mem.members[self] = struct{}{}
 	mem.membersMu.Unlock()
+	mem.watchers.Notify(cluster.Event{Type: cluster.NodeJoin, Node: self})
 	return nil
 }
 
@@ -37,6 +40,7 @@ func (mem *memDiscovery) leave(self cluster.Node) error {
 	mem.membersMu.Lock()
 	delete(mem.members, self)
 	mem.membersMu.Unlock()
+	mem.watchers.Notify(cluster.Event{Type: cluster.NodeLeave, Node: self})
 	return nil
 }
 
@@ -89,6 +93,10 @@ func (mem *memCluster) Members() []cluster.Node {
 	return mem.global.memberList()
 }
 
+func (mem *memCluster) Watch(fn func(cluster.Event)) func() {
+	return mem.global.watchers.Watch(fn)
+}
+
 func (mem *memCluster) Leave() error {
 	return mem.global.leave(mem.self)
 }
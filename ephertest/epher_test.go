@@ -3,12 +3,17 @@ package ephertest
 import (
 	"bytes"
 	"context"
+	"errors"
 	"math/rand"
+	"net/http"
 	"testing"
 
 	"time"
 
+	"github.com/aybabtme/epher/codec"
 	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -52,9 +57,46 @@ func TestStart(t *testing.T) {
 	}
 
 	t.Logf("can retrieve it from local node")
-	// checkRetrieveFromStore(local)
-	for _, remoteStore := range stores[1:2] {
-		t.Logf("can retrieve it from remote nodes")
+	checkRetrieveFromStore(local)
+	t.Logf("can retrieve it from remote nodes")
+	for _, remoteStore := range stores[1:] {
 		checkRetrieveFromStore(remoteStore)
 	}
 }
+
+func TestStartQuorumNotMet(t *testing.T) {
+	r := rand.New(rand.NewSource(42))
+
+	rc, err := ServiceDiscovery(t).Discover()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a single member can't make a write quorum of 2
+	svc := startService(t, r, rc, startStore(t))
+	defer svc.Close()
+
+	ctx, donectx := context.WithTimeout(context.Background(), 10*time.Second)
+	defer donectx()
+
+	want := []byte("123456789")
+
+	_, _, err = merkle.Build(ctx, bytes.NewReader(want), svc.Store(), merkle.WithBlobSize(1))
+	var qe *store.QuorumError
+	assert.True(t, errors.As(err, &qe), "%v", err)
+
+	h, err := thash.New(thash.Blake2B512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = h.Write(want)
+	cl, err := store.HTTPClient(svc.Addr().String(), codec.Binary(), &http.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cl.PutBlob(ctx, thash.MakeSum(h), want)
+	assert.Error(t, err)
+
+	_, found, err := cl.GetBlob(ctx, thash.MakeSum(h))
+	assert.NoError(t, err)
+	assert.False(t, found, "a write that failed was kept")
+}
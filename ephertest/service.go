@@ -15,8 +15,13 @@ import (
 func startService(t *testing.T, r *rand.Rand, rc cluster.RemoteCluster, st merkle.Store) service.Svc {
 	cd := codec.Binary()
 	svc, err := service.Start(r, rc, cd, st, func(nd cluster.Node) merkle.Store {
-		return store.HTTPClient(nd.Addr, cd, &http.Client{})
-	})
+		cl, err := store.HTTPClient(nd.Addr, cd, &http.Client{})
+		if err != nil {
+			// only a TLS config can fail, and there's none
+			panic(err)
+		}
+		return cl
+	}, service.WithReplication(store.Quorum{N: 3, W: 2, R: 2}))
 	if err != nil {
 		t.Fatal(err)
 	}
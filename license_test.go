@@ -27,10 +27,19 @@ func TestCheckLicenses(t *testing.T) {
 		license.LicenseEPL10:  struct{}{},
 	}
 
+	// licenses that can't be guessed, checked by hand
+	reviewed := map[string]string{
+		filepath.Join("vendor", "github.com", "zeebo", "blake3"): "CC0 1.0",
+	}
+
 	walkfn := func(path string, info os.FileInfo, err error) error {
 		if !info.IsDir() {
 			return nil
 		}
+		if lc, ok := reviewed[path]; ok {
+			t.Logf("OK! %v in %v", lc, path)
+			return nil
+		}
 
 		lc, err := license.NewFromDir(path)
 		switch err {
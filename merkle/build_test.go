@@ -0,0 +1,218 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildParallel(t *testing.T) {
+	ctx := context.Background()
+
+	data := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+
+	want, wantSum, err := merkle.Build(ctx, bytes.NewReader(data), store.NewMemoryStore(),
+		merkle.WithBlobSize(4<<10),
+		merkle.WithParallelism(1),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		parallelism = 8
+		maxInFlight = 20 << 10
+	)
+	slow := &slowStore{Store: store.NewMemoryStore(), delay: time.Millisecond}
+	got, gotSum, err := merkle.Build(ctx, bytes.NewReader(data), slow,
+		merkle.WithBlobSize(4<<10),
+		merkle.WithParallelism(parallelism),
+		merkle.WithMaxInFlight(maxInFlight),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, wantSum, gotSum)
+
+	assert.True(t, slow.maxCalls > 1, "blobs weren't put concurrently")
+	assert.True(t, slow.maxCalls <= parallelism, "%d blobs put at once", slow.maxCalls)
+	assert.True(t, slow.maxBytes <= maxInFlight, "%d bytes in flight", slow.maxBytes)
+
+	buf := bytes.NewBuffer(nil)
+	invalid, err := got.Retrieve(ctx, buf, slow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, invalid)
+	assert.Equal(t, data, buf.Bytes())
+}
+
+func TestBuildShape(t *testing.T) {
+	ctx := context.Background()
+
+	var leaves func(tree *merkle.Tree) int
+	leaves = func(tree *merkle.Tree) int {
+		if tree.Start == nil {
+			return 1
+		}
+		return leaves(tree.Start) + leaves(tree.End)
+	}
+	var check func(tree *merkle.Tree, st merkle.Store, separated bool)
+	check = func(tree *merkle.Tree, st merkle.Store, separated bool) {
+		if tree.Start == nil {
+			return
+		}
+		// the start of a node is half of it, or with domain
+		// separation, the largest perfect subtree that fits
+		n, start := leaves(tree), leaves(tree)/2
+		if separated {
+			start = 1
+			for start*2 < n {
+				start *= 2
+			}
+		}
+		assert.Equal(t, start, leaves(tree.Start), "%d blobs, separated=%v", n, separated)
+
+		_, found, err := st.GetNode(ctx, tree.HashSum)
+		assert.NoError(t, err)
+		assert.True(t, found, "node wasn't put")
+		check(tree.Start, st, separated)
+		check(tree.End, st, separated)
+	}
+	for _, separated := range []bool{false, true} {
+		for n := 1; n <= 33; n++ {
+			opts := []merkle.Option{merkle.WithBlobSize(1), merkle.WithParallelism(3)}
+			if separated {
+				opts = append(opts, merkle.WithDomainSeparation())
+			}
+			st := store.NewMemoryStore()
+			tree, _, err := merkle.Build(ctx, bytes.NewReader(make([]byte, n)), st, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, n, leaves(tree))
+			check(tree, st, separated)
+		}
+	}
+}
+
+// trees without domain separation must keep the sums they always had
+func TestBuildLegacySums(t *testing.T) {
+	ctx := context.Background()
+
+	data := make([]byte, 37)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	tests := []struct {
+		blobSize int64
+		want     string
+	}{
+		{7, "65b585150245465fc7a7c7f9bc1acca0e6fd85740b9fe45cc9bddb3a4902ca7397ad2f1c657d7edbc09763b8dbe3efeff9664fa09e7401b33a86365e2d4ca4de"},
+		{3, "05261d83c866a699f3974ab5e8c394753c86ec24c1dadd1ba955978fe3dd7469eebd07f48be122c0be33947a843fbb2a2f1d6ad9c766ebb54129ad371f5bcc06"},
+	}
+	for _, tt := range tests {
+		_, sum, err := merkle.Build(ctx, bytes.NewReader(data), store.NewMemoryStore(), merkle.WithBlobSize(tt.blobSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, thash.Blake2B512, sum.Type)
+		assert.Equal(t, tt.want, hex.EncodeToString([]byte(sum.Sum)), "blobs of %d bytes", tt.blobSize)
+	}
+}
+
+func TestBuildCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	data := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+
+	slow := &slowStore{Store: store.NewMemoryStore(), delay: time.Millisecond}
+	slow.onCall = func(calls int) {
+		if calls == 10 {
+			cancel()
+		}
+	}
+	tree, _, err := merkle.Build(ctx, bytes.NewReader(data), slow,
+		merkle.WithBlobSize(4<<10),
+		merkle.WithParallelism(4),
+	)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, tree)
+	assert.True(t, slow.calls < 256/2, "%d blobs were put after being canceled", slow.calls)
+}
+
+// slowStore takes its time to put and get blobs, and remembers how
+// many were in flight at once.
+type slowStore struct {
+	merkle.Store
+	delay  time.Duration
+	onCall func(calls int)
+
+	mu       sync.Mutex
+	calls    int
+	inCalls  int
+	inBytes  int
+	maxCalls int
+	maxBytes int
+}
+
+func (ss *slowStore) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	defer ss.enter(len(data))()
+	select {
+	case <-time.After(ss.delay):
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	return ss.Store.PutBlob(ctx, sum, data)
+}
+
+func (ss *slowStore) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	info, _, err := ss.Store.InfoBlob(ctx, sum)
+	if err != nil {
+		return nil, false, err
+	}
+	defer ss.enter(int(info.Size))()
+	select {
+	case <-time.After(ss.delay):
+	case <-ctx.Done():
+		return nil, false, ctx.Err()
+	}
+	return ss.Store.GetBlob(ctx, sum)
+}
+
+func (ss *slowStore) enter(size int) (leave func()) {
+	ss.mu.Lock()
+	ss.calls++
+	ss.inCalls++
+	ss.inBytes += size
+	if ss.inCalls > ss.maxCalls {
+		ss.maxCalls = ss.inCalls
+	}
+	if ss.inBytes > ss.maxBytes {
+		ss.maxBytes = ss.inBytes
+	}
+	if ss.onCall != nil {
+		ss.onCall(ss.calls)
+	}
+	ss.mu.Unlock()
+
+	return func() {
+		ss.mu.Lock()
+		ss.inCalls--
+		ss.inBytes -= size
+		ss.mu.Unlock()
+	}
+}
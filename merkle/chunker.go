@@ -0,0 +1,161 @@
+package merkle
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// A Chunker splits the content of a reader into the chunks that are
+// stored as blobs.
+type Chunker func(r io.Reader) Chunks
+
+// Chunks are the successive chunks of a reader.
+type Chunks interface {
+	// Next returns the next chunk, or io.EOF once there are none
+	// left. A chunk is only valid until the following call to Next.
+	Next() ([]byte, error)
+}
+
+// FixedSize splits a reader into chunks of size bytes, but for the
+// last one.
+func FixedSize(size int64) Chunker {
+	return func(r io.Reader) Chunks {
+		return &fixedChunks{r: r, size: size}
+	}
+}
+
+type fixedChunks struct {
+	r    io.Reader
+	size int64
+	buf  bytes.Buffer
+}
+
+func (fc *fixedChunks) Next() ([]byte, error) {
+	fc.buf.Reset()
+	n, err := io.CopyN(&fc.buf, fc.r, fc.size)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, io.EOF
+	}
+	return fc.buf.Bytes(), nil
+}
+
+// FastCDC splits a reader into chunks whose boundaries depend on their
+// content, using the FastCDC algorithm. An insertion or a deletion
+// only changes the chunks around it, so different versions of a file
+// share most of their chunks.
+//
+// Chunks are between min and max bytes long, and avg bytes long on
+// average. avg is rounded down to a power of two.
+func FastCDC(min, avg, max int) Chunker {
+	if min < 1 || min > avg || avg > max {
+		panic(fmt.Sprintf("invalid chunk sizes: need 0 < min (%d) <= avg (%d) <= max (%d)", min, avg, max))
+	}
+	// normalized chunking: cut points are harder to find before the
+	// average size, and easier after
+	b := bits.Len(uint(avg)) - 1
+	return func(r io.Reader) Chunks {
+		return &cdcChunks{
+			r:     r,
+			min:   min,
+			avg:   avg,
+			buf:   make([]byte, max),
+			maskS: gearMask(b + 2),
+			maskL: gearMask(b - 2),
+		}
+	}
+}
+
+// gearMask selects the high bits of the gear hash, which depend on
+// the most bytes.
+func gearMask(ones int) uint64 {
+	if ones < 1 {
+		return 0
+	}
+	if ones > 64 {
+		ones = 64
+	}
+	return ^uint64(0) << uint(64-ones)
+}
+
+type cdcChunks struct {
+	r        io.Reader
+	min, avg int
+	maskS    uint64
+	maskL    uint64
+
+	buf  []byte
+	n    int // bytes read in buf
+	off  int // start of the bytes not yet returned
+	done bool
+}
+
+func (cc *cdcChunks) Next() ([]byte, error) {
+	// keep what wasn't returned yet and fill the rest of the buffer
+	cc.n = copy(cc.buf, cc.buf[cc.off:cc.n])
+	cc.off = 0
+	if !cc.done {
+		n, err := io.ReadFull(cc.r, cc.buf[cc.n:])
+		cc.n += n
+		switch err {
+		case nil:
+		case io.EOF, io.ErrUnexpectedEOF:
+			cc.done = true
+		default:
+			return nil, err
+		}
+	}
+	if cc.n == 0 {
+		return nil, io.EOF
+	}
+	cc.off = cc.cut(cc.buf[:cc.n])
+	return cc.buf[:cc.off], nil
+}
+
+// cut finds the end of the chunk at the start of data.
+func (cc *cdcChunks) cut(data []byte) int {
+	n := len(data)
+	if n <= cc.min {
+		return n
+	}
+	normal := cc.avg
+	if normal > n {
+		normal = n
+	}
+	var (
+		fp uint64
+		i  = cc.min
+	)
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&cc.maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&cc.maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// gear maps bytes to random values. Chunk boundaries depend on it, so
+// it must never change.
+var gear = func() (table [256]uint64) {
+	// splitmix64
+	x := uint64(0x6570686572) // "epher"
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
@@ -0,0 +1,130 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFastCDC(t *testing.T) {
+	const min, avg, max = 2 << 10, 8 << 10, 32 << 10
+
+	data := make([]byte, 4<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+
+	sizes := chunkSizes(t, merkle.FastCDC(min, avg, max), data)
+	total := 0
+	for i, sz := range sizes {
+		if i != len(sizes)-1 {
+			assert.True(t, sz >= min, "chunk %d is too small: %d", i, sz)
+		}
+		assert.True(t, sz <= max, "chunk %d is too large: %d", i, sz)
+		total += sz
+	}
+	assert.Equal(t, len(data), total)
+
+	mean := total / len(sizes)
+	assert.InDelta(t, avg, mean, avg/2, "average chunk size")
+
+	assert.Equal(t, sizes, chunkSizes(t, merkle.FastCDC(min, avg, max), data), "chunking isn't deterministic")
+}
+
+func TestFastCDCSharesBlobs(t *testing.T) {
+	data := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+
+	// insert a byte at the start and overwrite some in the middle
+	edited := append([]byte{'x'}, data...)
+	copy(edited[len(edited)/2:], "hello world")
+
+	cdc := merkle.FastCDC(1<<10, 4<<10, 16<<10)
+	shared := sharedBlobs(t, cdc, data, edited)
+	assert.True(t, shared > 0.9, "only %.2f of the blobs are shared", shared)
+
+	fixed := merkle.FixedSize(4 << 10)
+	shared = sharedBlobs(t, fixed, data, edited)
+	assert.True(t, shared < 0.1, "%.2f of the blobs are shared", shared)
+}
+
+func TestBuildWithChunker(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+
+	_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st,
+		merkle.WithChunker(merkle.FastCDC(1<<10, 4<<10, 16<<10)),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := merkle.RetrieveTree(ctx, sum, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(want)), tree.SizeByte)
+
+	buf := bytes.NewBuffer(nil)
+	invalid, err := tree.Retrieve(ctx, buf, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, invalid)
+	assert.Equal(t, want, buf.Bytes())
+}
+
+func chunkSizes(t *testing.T, chunker merkle.Chunker, data []byte) []int {
+	var sizes []int
+	chunks := chunker(bytes.NewReader(data))
+	for {
+		chunk, err := chunks.Next()
+		if err == io.EOF {
+			return sizes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		sizes = append(sizes, len(chunk))
+	}
+}
+
+// sharedBlobs tells the fraction of the blobs of b that are also
+// blobs of a.
+func sharedBlobs(t *testing.T, chunker merkle.Chunker, a, b []byte) float64 {
+	sums := func(data []byte) []string {
+		var sums []string
+		chunks := chunker(bytes.NewReader(data))
+		for {
+			chunk, err := chunks.Next()
+			if err == io.EOF {
+				return sums
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			h, _ := thash.New(thash.Blake2B512)
+			_, _ = h.Write(chunk)
+			sums = append(sums, string(h.Sum(nil)))
+		}
+	}
+	inA := make(map[string]bool)
+	for _, sum := range sums(a) {
+		inA[sum] = true
+	}
+	shared, all := 0, sums(b)
+	for _, sum := range all {
+		if inA[sum] {
+			shared++
+		}
+	}
+	return float64(shared) / float64(len(all))
+}
@@ -0,0 +1,87 @@
+package merkle
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/aybabtme/epher/thash"
+)
+
+// Trees with domain separation hash their blobs and nodes like RFC 6962
+// does, prefixed with a byte telling which they are. The prefix also
+// binds the number of bytes hashed, for blobs, or the description of
+// each child, for nodes:
+//
+//	blob: H(0x00 || size || data)
+//	node: H(0x01 || start kind || end kind || start size || end size || start sum || end sum)
+//
+// Kinds are a byte, sizes are big endian uint64s.
+const (
+	blobPrefix   = 0x00
+	branchPrefix = 0x01
+)
+
+var errNoHashKey = errors.New("the tree is keyed, but no key was given: see merkle.WithHashKey")
+
+// BlobHash returns the hash that sums a blob of size bytes, of type t.
+// Keyed types need WithHashKey.
+func BlobHash(t thash.Type, size int64, opts ...Option) (thash.Hash, error) {
+	return newConfig(opts).blobHash(t, size)
+}
+
+func (config *config) blobHash(t thash.Type, size int64) (thash.Hash, error) {
+	h, err := config.newHash(t)
+	if err != nil {
+		return nil, err
+	}
+	if t&thash.DomainSeparated != 0 {
+		writePrefix(h, []byte{blobPrefix}, size)
+	}
+	return h, nil
+}
+
+// NodeSum is the sum a node should have, given its children. Nodes of
+// trees with domain separation must describe their children. Keyed
+// types need WithHashKey.
+func NodeSum(node Node, opts ...Option) (thash.Sum, error) {
+	return newConfig(opts).nodeSum(node)
+}
+
+// branchSum is the sum of a node with the given children.
+func (config *config) branchSum(start, end *Tree) (thash.Sum, error) {
+	return config.nodeSum(nodeOf(&Tree{Start: start, End: end}))
+}
+
+func (config *config) nodeSum(node Node) (thash.Sum, error) {
+	t := node.Start.Type
+	h, err := config.newHash(t)
+	if err != nil {
+		return thash.Sum{}, err
+	}
+	if t&thash.DomainSeparated != 0 {
+		writePrefix(h, []byte{branchPrefix, byte(node.StartKind), byte(node.EndKind)}, node.StartSize, node.EndSize)
+	}
+	_, _ = io.WriteString(h, node.Start.Sum)
+	_, _ = io.WriteString(h, node.End.Sum)
+	return thash.MakeSum(h), nil
+}
+
+func (config *config) newHash(t thash.Type) (thash.Hash, error) {
+	if t&thash.Keyed == 0 {
+		return thash.New(t)
+	}
+	if len(config.HashKey) == 0 {
+		return nil, errNoHashKey
+	}
+	return thash.NewKeyed(t, config.HashKey)
+}
+
+func writePrefix(h thash.Hash, prefix []byte, sizes ...int64) {
+	buf := make([]byte, len(prefix)+8*len(sizes))
+	n := copy(buf, prefix)
+	for i, size := range sizes {
+		binary.BigEndian.PutUint64(buf[n+8*i:], uint64(size))
+	}
+	_, _ = h.Write(buf)
+}
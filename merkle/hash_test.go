@@ -0,0 +1,197 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDomainSeparation(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 64<<10)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+
+	plain, plainSum, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st,
+		merkle.WithBlobSize(4<<10),
+		merkle.WithDomainSeparation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, thash.Blake2B512|thash.DomainSeparated, sum.Type)
+	assert.Equal(t, thash.Blake2B512, sum.Type.Func())
+	assert.NotEqual(t, plainSum.Sum, sum.Sum)
+
+	// both kinds of trees live in the same store
+	for _, sum := range []thash.Sum{plainSum, sum} {
+		tree, err := merkle.RetrieveTree(ctx, sum, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		buf := bytes.NewBuffer(nil)
+		invalid, err := tree.Retrieve(ctx, buf, st)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Empty(t, invalid)
+		assert.Equal(t, want, buf.Bytes())
+	}
+
+	// without separation, the children of a node make a blob with the
+	// same sum as the node
+	concat := []byte(plain.Start.HashSum.Sum + plain.End.HashSum.Sum)
+	h, err := merkle.BlobHash(plainSum.Type, int64(len(concat)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = h.Write(concat)
+	assert.Equal(t, plainSum, thash.MakeSum(h))
+
+	tree, err := merkle.RetrieveTree(ctx, sum, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	concat = []byte(tree.Start.HashSum.Sum + tree.End.HashSum.Sum)
+	h, err = merkle.BlobHash(sum.Type, int64(len(concat)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = h.Write(concat)
+	assert.NotEqual(t, sum, thash.MakeSum(h))
+}
+
+func TestDomainSeparationBindsSizes(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	tree, _, err := merkle.Build(ctx, bytes.NewReader([]byte("0123456789abcdef")), st,
+		merkle.WithBlobSize(4),
+		merkle.WithDomainSeparation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a node that lies about the sizes of its children
+	tree.Start.SizeByte, tree.End.SizeByte = 4, 12
+	invalid, err := tree.Retrieve(ctx, nil, st, merkle.WithParallelism(1))
+	assert.NoError(t, err)
+	assert.Equal(t, []*merkle.Tree{tree}, invalid)
+}
+
+func TestDomainSeparationBindsKinds(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	_, sum, err := merkle.Build(ctx, bytes.NewReader([]byte("0123456789abcdef")), st,
+		merkle.WithBlobSize(4),
+		merkle.WithDomainSeparation(),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, found, err := st.GetNode(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, found)
+	got, err := merkle.NodeSum(node)
+	assert.NoError(t, err)
+	assert.Equal(t, sum, got)
+
+	// a node that lies about the kinds of its children
+	node.StartKind, node.EndKind = merkle.BlobChild, merkle.BlobChild
+	got, err = merkle.NodeSum(node)
+	assert.NoError(t, err)
+	assert.NotEqual(t, sum, got)
+}
+
+func TestHashTypes(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 64<<10)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+
+	types := []thash.Type{thash.Blake2B512, thash.SHA3, thash.SHA256, thash.Blake2B256, thash.Blake3}
+	for _, typ := range types {
+		for _, separated := range []bool{false, true} {
+			opts := []merkle.Option{merkle.WithBlobSize(4 << 10), merkle.WithHashType(typ)}
+			if separated {
+				opts = append(opts, merkle.WithDomainSeparation())
+			}
+			_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assert.Equal(t, typ, sum.Type.Func())
+			assert.Equal(t, typ.Size(), len(sum.Sum))
+
+			tree, err := merkle.RetrieveTree(ctx, sum, st)
+			if err != nil {
+				t.Fatal(err)
+			}
+			buf := bytes.NewBuffer(nil)
+			invalid, err := tree.Retrieve(ctx, buf, st)
+			assert.NoError(t, err, sum.Type.String())
+			assert.Empty(t, invalid, sum.Type.String())
+			assert.Equal(t, want, buf.Bytes(), sum.Type.String())
+		}
+	}
+
+	_, _, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithHashType(thash.Type(42)))
+	assert.Error(t, err)
+}
+
+func TestHashKey(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 64<<10)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+
+	key := merkle.WithHashKey([]byte("not so secret"))
+	_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st,
+		merkle.WithBlobSize(4<<10),
+		merkle.WithHashType(thash.Blake2B256),
+		key,
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, thash.Blake2B256|thash.Keyed, sum.Type)
+
+	tree, err := merkle.RetrieveTree(ctx, sum, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := bytes.NewBuffer(nil)
+	invalid, err := tree.Retrieve(ctx, buf, st, key)
+	assert.NoError(t, err)
+	assert.Empty(t, invalid)
+	assert.Equal(t, want, buf.Bytes())
+
+	// can't be verified without the key
+	_, err = tree.Retrieve(ctx, nil, st)
+	assert.Error(t, err)
+	_, err = tree.Retrieve(ctx, nil, st, merkle.WithHashKey([]byte("wrong")))
+	assert.Error(t, err)
+	_, err = tree.NewReader(ctx, st).ReadAt(make([]byte, 1), 0)
+	assert.Error(t, err)
+
+	// only BLAKE2b can be keyed
+	_, _, err = merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithHashType(thash.SHA256), key)
+	assert.Error(t, err)
+}
@@ -1,13 +1,12 @@
 package merkle
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"strings"
+	"strconv"
 
 	"github.com/aybabtme/epher/thash"
 )
@@ -23,14 +22,20 @@ type Store interface {
 type Option func(*config)
 
 type config struct {
-	HashType thash.Type
-	BlobSize int64
+	HashType    thash.Type
+	HashKey     []byte
+	Separated   bool
+	Chunker     Chunker
+	Parallelism int
+	MaxInFlight int64
 }
 
 func newConfig(opts []Option) *config {
 	def := &config{
-		HashType: thash.Blake2B512,
-		BlobSize: 4 << 20, // 4MiB
+		HashType:    thash.Blake2B512,
+		Chunker:     FixedSize(4 << 20), // 4MiB
+		Parallelism: 4,
+		MaxInFlight: 16 << 20, // 16MiB
 	}
 	for _, o := range opts {
 		o(def)
@@ -38,61 +43,124 @@ func newConfig(opts []Option) *config {
 	return def
 }
 
-func WithBlobSize(sz int64) Option      { return func(opts *config) { opts.BlobSize = sz } }
+// WithBlobSize splits data into blobs of a fixed size.
+func WithBlobSize(sz int64) Option      { return WithChunker(FixedSize(sz)) }
 func WithHashType(ht thash.Type) Option { return func(opts *config) { opts.HashType = ht } }
 
+// WithDomainSeparation hashes blobs and nodes with distinct prefixes, so
+// that a blob can never pass for a node of a tree. Such trees are split
+// like RFC 6962 rather than in halves, see Build, and their sums have
+// the thash.DomainSeparated flag.
+func WithDomainSeparation() Option { return func(opts *config) { opts.Separated = true } }
+
+// WithHashKey keys the hash of the trees that are built, so that only
+// those who know key can compute or verify their sums. It's meant for
+// private clusters, and needs one of the BLAKE2b hash types. Trees that
+// are keyed can only be retrieved with the same key.
+func WithHashKey(key []byte) Option { return func(opts *config) { opts.HashKey = key } }
+
+func (config *config) hashType() thash.Type {
+	t := config.HashType
+	if config.Separated {
+		t |= thash.DomainSeparated
+	}
+	if len(config.HashKey) != 0 {
+		t |= thash.Keyed
+	}
+	return t
+}
+
+// WithChunker sets how data is split into blobs.
+func WithChunker(c Chunker) Option { return func(opts *config) { opts.Chunker = c } }
+
+// WithParallelism sets how many blobs and nodes are put in or fetched
+// from the store at once.
+func WithParallelism(n int) Option { return func(opts *config) { opts.Parallelism = n } }
+
+// WithMaxInFlight bounds the size of the blobs being put in or
+// fetched from the store at once.
+func WithMaxInFlight(sz int64) Option { return func(opts *config) { opts.MaxInFlight = sz } }
+
+// Build splits the data read from r into blobs, and puts them in store
+// along with the nodes of the tree over them. The tree is the same
+// however many blobs are put at once.
+//
+// Trees split their blobs in halves, so their nodes can only be made
+// once every blob is put. Trees with domain separation instead split
+// them like RFC 6962, in perfect subtrees of decreasing size: blobs
+// are folded into the tree in order as soon as they're put, like a
+// binary counter, and the nodes it makes are put right away.
 func Build(ctx context.Context, r io.Reader, store Store, opts ...Option) (*Tree, thash.Sum, error) {
 
 	config := newConfig(opts)
+	if _, err := config.newHash(config.hashType()); err != nil {
+		return nil, thash.Sum{}, err
+	}
 
-	rdbuf := bytes.NewBuffer(nil)
-
-	var bis []BlobInfo
-
-	reachedEOF := false
-	for !reachedEOF {
-		rdbuf.Reset()
-
-		n, err := io.CopyN(rdbuf, r, config.BlobSize)
-		if err != nil && err != io.EOF {
-			return nil, thash.Sum{}, err
+	chunks := config.Chunker(r)
+
+	up := newUploader(ctx, store, config)
+	f := &fold{config: config, put: up.putNode}
+
+	// the blobs are put concurrently, but are folded in order. the
+	// blobs that are put before those ahead of them wait, but no more
+	// than there are blobs being put
+	var pending []*pendingBlob
+	foldDone := func(keep int) bool {
+		for len(pending) > 0 {
+			select {
+			case <-pending[0].done:
+			default:
+				if len(pending) <= keep {
+					return true
+				}
+				<-pending[0].done
+			}
+			if up.stopped() {
+				return false
+			}
+			if err := f.push(&Tree{HashSum: pending[0].info.Sum, SizeByte: pending[0].info.Size}); err != nil {
+				up.fail(err)
+				return false
+			}
+			pending[0] = nil
+			pending = pending[1:]
 		}
-		reachedEOF = (err == io.EOF)
-		if n == 0 {
+		return true
+	}
+	for {
+		data, err := chunks.Next()
+		if err == io.EOF {
 			break
 		}
-
-		data := rdbuf.Bytes()
-
-		sum, n, err := copyBlob(config.HashType, ioutil.Discard, rdbuf)
 		if err != nil {
-			return nil, thash.Sum{}, err
+			up.fail(err)
+			break
 		}
-
-		if err := store.PutBlob(ctx, sum, data); err != nil {
-			return nil, thash.Sum{}, err
+		blob, ok := up.putBlob(data)
+		if !ok {
+			break
+		}
+		pending = append(pending, blob)
+		if !foldDone(config.Parallelism) {
+			break
 		}
-
-		bis = append(bis, BlobInfo{Sum: sum, Size: n})
 	}
-
-	tree := newTree(bis)
-	if err := tree.persist(ctx, store); err != nil {
+	var tree *Tree
+	if foldDone(0) {
+		var err error
+		if tree, err = f.root(); err != nil {
+			up.fail(err)
+		}
+	}
+	if err := up.wait(); err != nil {
 		return nil, thash.Sum{}, err
 	}
-	return tree, tree.HashSum, nil
-}
-
-func copyBlob(t thash.Type, w io.Writer, r io.Reader) (thash.Sum, int64, error) {
-
-	h := thash.New(t)
-
-	n, err := io.Copy(w, io.TeeReader(r, h))
-	if err != nil {
-		return thash.Sum{}, n, err
+	if tree == nil {
+		// there was no data
+		return nil, thash.Sum{}, nil
 	}
-
-	return thash.MakeSum(h), n, err
+	return tree, tree.HashSum, nil
 }
 
 var (
@@ -102,46 +170,94 @@ var (
 
 // Node is a node in a merkle tree. A node is sufficient
 // to retrieve the whole of a merkle tree rooted in this node.
+//
+// Nodes also describe their children: whether each is a node or a blob,
+// and how many bytes of data it holds. Nodes written before children
+// were described have an UnknownChild kind and no sizes. The hash sum of
+// the node only covers the description in trees with domain separation.
+// Otherwise, a size that lies is caught when the data of the leaf is
+// read, and a described node can be replaced by one that describes its
+// children differently.
 type Node struct {
 	Sum        thash.Sum
 	Start, End thash.Sum
+
+	StartKind, EndKind ChildKind
+	StartSize, EndSize int64
 }
 
-func RetrieveTree(ctx context.Context, sum thash.Sum, store Store) (*Tree, error) {
-	root, found, err := store.GetNode(ctx, sum)
-	if err != nil {
-		return nil, err
-	}
-	if !found {
-		return &Tree{HashSum: sum}, nil
+// Described tells if the node knows what its children are.
+func (node Node) Described() bool {
+	return node.StartKind != UnknownChild && node.EndKind != UnknownChild
+}
+
+// Size is the number of bytes of data under a described node.
+func (node Node) Size() int64 {
+	return node.StartSize + node.EndSize
+}
+
+// ChildKind tells whether the child of a node is a node or a blob.
+type ChildKind uint8
+
+const (
+	UnknownChild ChildKind = iota
+	NodeChild
+	BlobChild
+)
+
+func (k ChildKind) String() string {
+	switch k {
+	case UnknownChild:
+		return "unknown"
+	case NodeChild:
+		return "node"
+	case BlobChild:
+		return "blob"
 	}
-	start, err := RetrieveTree(ctx, root.Start, store)
-	if err != nil {
-		return nil, err
+	return "ChildKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+func (k ChildKind) MarshalText() ([]byte, error) {
+	if k > BlobChild {
+		return nil, fmt.Errorf("invalid child kind %d", k)
 	}
-	end, err := RetrieveTree(ctx, root.End, store)
-	if err != nil {
-		return nil, err
+	return []byte(k.String()), nil
+}
+
+func (k *ChildKind) UnmarshalText(text []byte) error {
+	for _, kind := range []ChildKind{UnknownChild, NodeChild, BlobChild} {
+		if string(text) == kind.String() {
+			*k = kind
+			return nil
+		}
 	}
-	tree := &Tree{Start: start, End: end, HashSum: sum}
+	return fmt.Errorf("invalid child kind %q", text)
+}
 
-	// set the sizes
-	err = walk(tree, func(branch *Tree) error {
-		branch.SizeByte = branch.Start.SizeByte + branch.End.SizeByte
-		return nil
-	}, func(leaf *Tree) error {
-		bi, _, err := store.InfoBlob(ctx, leaf.HashSum)
-		leaf.SizeByte = bi.Size
-		return err
-	})
+func kindOf(tree *Tree) ChildKind {
+	if tree.Start == nil && tree.End == nil {
+		return BlobChild
+	}
+	return NodeChild
+}
 
-	return tree, err
+// nodeOf describes a branch of a tree as a node.
+func nodeOf(branch *Tree) Node {
+	return Node{
+		Sum:       branch.HashSum,
+		Start:     branch.Start.HashSum,
+		End:       branch.End.HashSum,
+		StartKind: kindOf(branch.Start),
+		EndKind:   kindOf(branch.End),
+		StartSize: branch.Start.SizeByte,
+		EndSize:   branch.End.SizeByte,
+	}
 }
 
 // Tree is a concrete merkle tree.
 type Tree struct {
-	Start *Tree `json:"start"`
-	End   *Tree `json:"end"`
+	Start *Tree `json:"start,omitempty"`
+	End   *Tree `json:"end,omitempty"`
 
 	SizeByte int64     `json:"size_byte"`
 	HashSum  thash.Sum `json:"hash_sum"`
@@ -170,14 +286,26 @@ func walk(tree *Tree, onBranch, onLeaf func(*Tree) error) error {
 	}
 }
 
-func (tree *Tree) Retrieve(ctx context.Context, wr io.Writer, store Store) (invalid []*Tree, err error) {
+// Retrieve writes the data of the tree to wr, verifying it along the
+// way. It returns the subtrees that didn't match their hash sum.
+//
+// Up to WithParallelism leaves are fetched ahead of the one being
+// written, as long as they fit in WithMaxInFlight. They're verified
+// before being written, in order. Without parallelism, leaves are
+// streamed to wr as they're fetched and verified after.
+func (tree *Tree) Retrieve(ctx context.Context, wr io.Writer, store Store, opts ...Option) (invalid []*Tree, err error) {
 	if wr == nil {
 		wr = ioutil.Discard
 	}
-	return tree.retrieve(ctx, wr, store)
+	config := newConfig(opts)
+	if config.Parallelism > 1 {
+		return tree.retrieveWindow(ctx, wr, store, config)
+	}
+	return tree.retrieve(ctx, wr, store, config)
 }
 
-func (tree *Tree) retrieve(ctx context.Context, wr io.Writer, store Store) (invalid []*Tree, err error) {
+func (tree *Tree) retrieve(ctx context.Context, wr io.Writer, store Store, config *config) (invalid []*Tree, err error) {
+	ss := Streaming(store)
 	onBranch := func(branch *Tree) error {
 		// verify that this.sum == sum(start.sum, end.sum)
 		// then verify:
@@ -185,14 +313,19 @@ func (tree *Tree) retrieve(ctx context.Context, wr io.Writer, store Store) (inva
 		//   - end
 
 		// we're a sum of hash sum
-		got := sumHashWithTree(branch.Start, branch.End)
-		if !branch.HashSum.Equal(got) {
+		got, err := config.branchSum(branch.Start, branch.End)
+		if err != nil || !branch.HashSum.Equal(got) {
 			invalid = append(invalid, branch) // we're invalid
 		}
 		return nil
 	}
 	onLeaf := func(leaf *Tree) error {
-		blob, found, err := store.GetBlob(ctx, leaf.HashSum)
+		h, err := config.blobHash(leaf.HashSum.Type, leaf.SizeByte)
+		if err != nil {
+			invalid = []*Tree{leaf}
+			return err
+		}
+		found, err := ss.GetBlobStream(ctx, leaf.HashSum, io.MultiWriter(wr, h))
 		if err != nil {
 			invalid = []*Tree{leaf}
 			return err
@@ -202,39 +335,46 @@ func (tree *Tree) retrieve(ctx context.Context, wr io.Writer, store Store) (inva
 			return errDataMissing
 		}
 
-		got, _, err := copyBlob(leaf.HashSum.Type, wr, bytes.NewReader(blob))
-		if err != nil {
-			invalid = []*Tree{leaf}
-			return err
-		}
+		got := thash.MakeSum(h)
 		if !leaf.HashSum.Equal(got) {
 			invalid = []*Tree{leaf}
-			return fmt.Errorf("want sum %x, got %x", leaf.HashSum.Sum, got.Sum, blob)
+			return fmt.Errorf("want sum %x, got %x", leaf.HashSum.Sum, got.Sum)
 		}
 		return nil
 	}
 	return invalid, walk(tree, onBranch, onLeaf)
 }
 
-func (tree *Tree) persist(ctx context.Context, store Store) error {
-
+func (tree *Tree) persist(ctx context.Context, store Store, parallelism int) error {
+	var nodes []Node
 	onBranch := func(branch *Tree) error {
-		if err := branch.Start.persist(ctx, store); err != nil {
-			return err
-		}
-		if err := branch.End.persist(ctx, store); err != nil {
-			return err
-		}
-		return store.PutNode(ctx, Node{
-			Sum:   branch.HashSum,
-			Start: branch.Start.HashSum,
-			End:   branch.End.HashSum,
-		})
+		nodes = append(nodes, nodeOf(branch))
+		return nil
 	}
 	onLeaf := func(leaf *Tree) error {
 		return nil
 	}
-	return walk(tree, onBranch, onLeaf)
+	if err := walk(tree, onBranch, onLeaf); err != nil {
+		return err
+	}
+	return forEach(ctx, len(nodes), parallelism, func(ctx context.Context, i int) error {
+		return store.PutNode(ctx, nodes[i])
+	})
+}
+
+// Upgrade rewrites the nodes of the tree rooted in sum so that they
+// describe their children. Retrieving a tree whose nodes don't has to
+// ask the store about every one of its blobs.
+func Upgrade(ctx context.Context, sum thash.Sum, store Store, opts ...Option) (*Tree, error) {
+	config := newConfig(opts)
+	tree, err := RetrieveTree(ctx, sum, store, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if err := tree.persist(ctx, store, config.Parallelism); err != nil {
+		return nil, err
+	}
+	return tree, nil
 }
 
 type BlobInfo struct {
@@ -242,47 +382,92 @@ type BlobInfo struct {
 	Size int64
 }
 
-func newTree(bis []BlobInfo) *Tree {
-	switch n := len(bis); n {
-	case 0: // no data
+// fold builds a tree one blob at a time. With domain separation, it
+// keeps a subtree of 2^i blobs at levels[i] until another one completes
+// it. Otherwise, it keeps every blob until the tree can be split in
+// halves.
+type fold struct {
+	config *config
+	put    func(Node) error
+	levels []*Tree
+	leaves []*Tree
+}
+
+func (f *fold) push(tree *Tree) error {
+	if !f.config.Separated {
+		f.leaves = append(f.leaves, tree)
 		return nil
-	case 1: // we're a leaf
-		bi := bis[0]
-		return &Tree{
-			HashSum:  bi.Sum,
-			SizeByte: bi.Size,
+	}
+	for i := 0; ; i++ {
+		if i == len(f.levels) {
+			f.levels = append(f.levels, nil)
 		}
-	default:
-
-		var (
-			start = newTree(bis[:n/2])
-			end   = newTree(bis[n/2:])
-		)
-		if start == nil {
-			panic("should not be possible")
+		if f.levels[i] == nil {
+			f.levels[i] = tree
+			return nil
 		}
-		if end == nil {
-			// we're a tree of odd size
-			return start
+		var err error
+		if tree, err = f.branch(f.levels[i], tree); err != nil {
+			return err
 		}
+		f.levels[i] = nil
+	}
+}
 
-		// we have two child nodes, so compute the hash sum of their appended hash sums
+// root joins the subtrees that are left, smallest first. It's nil if
+// no blob was pushed.
+func (f *fold) root() (*Tree, error) {
+	if !f.config.Separated {
+		return f.halves(f.leaves)
+	}
+	var root *Tree
+	for _, tree := range f.levels {
+		switch {
+		case tree == nil:
+		case root == nil:
+			root = tree
+		default:
+			var err error
+			if root, err = f.branch(tree, root); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return root, nil
+}
 
-		return &Tree{
-			Start:    start,
-			End:      end,
-			SizeByte: start.SizeByte + end.SizeByte,
-			HashSum:  sumHashWithTree(start, end),
+func (f *fold) halves(leaves []*Tree) (*Tree, error) {
+	switch n := len(leaves); n {
+	case 0: // no data
+		return nil, nil
+	case 1:
+		return leaves[0], nil
+	default:
+		start, err := f.halves(leaves[:n/2])
+		if err != nil {
+			return nil, err
 		}
+		end, err := f.halves(leaves[n/2:])
+		if err != nil {
+			return nil, err
+		}
+		return f.branch(start, end)
 	}
 }
 
-func sumHashWithTree(start, end *Tree) thash.Sum {
-	appendedSums := start.HashSum.Sum + end.HashSum.Sum
-	h := thash.New(start.HashSum.Type)
-	_, err := io.Copy(h, strings.NewReader(appendedSums))
+func (f *fold) branch(start, end *Tree) (*Tree, error) {
+	sum, err := f.config.branchSum(start, end)
 	if err != nil {
-		panic(err) // should never happen
+		return nil, err
+	}
+	tree := &Tree{
+		Start:    start,
+		End:      end,
+		SizeByte: start.SizeByte + end.SizeByte,
+		HashSum:  sum,
+	}
+	if err := f.put(nodeOf(tree)); err != nil {
+		return nil, err
 	}
-	return thash.MakeSum(h)
+	return tree, nil
 }
@@ -0,0 +1,106 @@
+package merkle
+
+import (
+	"context"
+	"sync"
+)
+
+// forEach calls fn with every index up to n, running at most
+// parallelism calls at once. It stops at the first error, which it
+// returns.
+func forEach(ctx context.Context, n, parallelism int, fn func(ctx context.Context, i int) error) error {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg      sync.WaitGroup
+		errOnce sync.Once
+		first   error
+		idx     = make(chan int)
+	)
+	for w := 0; w < parallelism && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range idx {
+				if err := fn(ctx, i); err != nil {
+					errOnce.Do(func() { first = err })
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case idx <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(idx)
+	wg.Wait()
+	if first != nil {
+		return first
+	}
+	return ctx.Err()
+}
+
+// budget bounds the bytes held at once by concurrent operations.
+type budget struct {
+	mu    sync.Mutex
+	max   int64
+	used  int64
+	freed chan struct{} // closed whenever bytes are released
+}
+
+func newBudget(max int64) *budget {
+	return &budget{max: max, freed: make(chan struct{})}
+}
+
+// acquire waits until n more bytes fit in the budget. Operations
+// larger than the whole budget are let through once nothing else is
+// held, rather than never.
+func (b *budget) acquire(ctx context.Context, n int64) error {
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		b.mu.Lock()
+		if b.used == 0 || b.used+n <= b.max {
+			b.used += n
+			b.mu.Unlock()
+			return nil
+		}
+		freed := b.freed
+		b.mu.Unlock()
+
+		select {
+		case <-freed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// tryAcquire takes n bytes from the budget if they fit right away.
+func (b *budget) tryAcquire(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used == 0 || b.used+n <= b.max {
+		b.used += n
+		return true
+	}
+	return false
+}
+
+func (b *budget) release(n int64) {
+	b.mu.Lock()
+	b.used -= n
+	close(b.freed)
+	b.freed = make(chan struct{})
+	b.mu.Unlock()
+}
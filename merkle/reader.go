@@ -0,0 +1,157 @@
+package merkle
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aybabtme/epher/thash"
+)
+
+// Reader reads the data of a tree at random, fetching only the leaves
+// that cover the bytes being read. Leaves are verified against their
+// hash sum before any of their bytes are returned.
+type Reader struct {
+	ctx    context.Context
+	tree   *Tree
+	store  Store
+	config *config
+
+	mu  sync.Mutex
+	off int64 // for Read and Seek
+
+	// the last leaf that was read, since reads tend to be sequential
+	cacheMu   sync.Mutex
+	cacheLeaf *Tree
+	cacheData []byte
+}
+
+var (
+	_ io.ReadSeeker = (*Reader)(nil)
+	_ io.ReaderAt   = (*Reader)(nil)
+)
+
+// NewReader reads the data of the tree from store. The sizes of the
+// tree must be known, as they are for trees returned by Build and
+// RetrieveTree.
+func (tree *Tree) NewReader(ctx context.Context, store Store, opts ...Option) *Reader {
+	return &Reader{ctx: ctx, tree: tree, store: store, config: newConfig(opts)}
+}
+
+// Size is the number of bytes represented by the tree.
+func (rd *Reader) Size() int64 {
+	if rd.tree == nil {
+		return 0
+	}
+	return rd.tree.SizeByte
+}
+
+func (rd *Reader) Read(p []byte) (int, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	n, err := rd.ReadAt(p, rd.off)
+	rd.off += int64(n)
+	if err == io.EOF && n != 0 {
+		// report EOF on the next call, like most readers
+		err = nil
+	}
+	return n, err
+}
+
+func (rd *Reader) Seek(offset int64, whence int) (int64, error) {
+	rd.mu.Lock()
+	defer rd.mu.Unlock()
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rd.off
+	case io.SeekEnd:
+		offset += rd.Size()
+	default:
+		return 0, errors.New("merkle.Reader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("merkle.Reader.Seek: negative position")
+	}
+	rd.off = offset
+	return offset, nil
+}
+
+func (rd *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("merkle.Reader.ReadAt: negative offset")
+	}
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= rd.Size() {
+			return n, io.EOF
+		}
+		leaf, start, err := findLeaf(rd.tree, pos)
+		if err != nil {
+			return n, err
+		}
+		data, err := rd.leafData(leaf)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], data[pos-start:])
+	}
+	return n, nil
+}
+
+// findLeaf descends the tree to the leaf holding the byte at pos, and
+// tells where that leaf starts.
+func findLeaf(tree *Tree, pos int64) (leaf *Tree, start int64, err error) {
+	for {
+		switch {
+		case tree.Start == nil && tree.End == nil:
+			return tree, start, nil
+		case tree.Start != nil && tree.End != nil:
+			if pos < start+tree.Start.SizeByte {
+				tree = tree.Start
+			} else {
+				start += tree.Start.SizeByte
+				tree = tree.End
+			}
+		default:
+			return nil, 0, errMalformedTree
+		}
+	}
+}
+
+func (rd *Reader) leafData(leaf *Tree) ([]byte, error) {
+	rd.cacheMu.Lock()
+	if rd.cacheLeaf == leaf {
+		data := rd.cacheData
+		rd.cacheMu.Unlock()
+		return data, nil
+	}
+	rd.cacheMu.Unlock()
+
+	data, found, err := rd.store.GetBlob(rd.ctx, leaf.HashSum)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, errDataMissing
+	}
+	h, err := rd.config.blobHash(leaf.HashSum.Type, leaf.SizeByte)
+	if err != nil {
+		return nil, err
+	}
+	_, _ = h.Write(data)
+	if got := thash.MakeSum(h); !leaf.HashSum.Equal(got) {
+		return nil, fmt.Errorf("want sum %x, got %x", leaf.HashSum.Sum, got.Sum)
+	}
+	if int64(len(data)) != leaf.SizeByte {
+		return nil, fmt.Errorf("leaf %x should be %d bytes, was %d", leaf.HashSum.Sum, leaf.SizeByte, len(data))
+	}
+
+	rd.cacheMu.Lock()
+	rd.cacheLeaf, rd.cacheData = leaf, data
+	rd.cacheMu.Unlock()
+	return data, nil
+}
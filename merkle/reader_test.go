@@ -0,0 +1,92 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReader(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 1<<20)
+	r := rand.New(rand.NewSource(42))
+	_, _ = r.Read(want)
+	_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tree, err := merkle.RetrieveTree(ctx, sum, st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	counting := &slowStore{Store: st}
+	rd := tree.NewReader(ctx, counting)
+	assert.Equal(t, int64(len(want)), rd.Size())
+
+	// random ranges, which may cross leaves
+	for i := 0; i < 100; i++ {
+		off := r.Int63n(int64(len(want)))
+		p := make([]byte, r.Intn(10<<10))
+		n, err := rd.ReadAt(p, off)
+		end := off + int64(len(p))
+		if end > int64(len(want)) {
+			end = int64(len(want))
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, want[off:end], p[:n])
+	}
+
+	// only the leaves covering a range are fetched
+	counting.calls = 0
+	p := make([]byte, 10)
+	if _, err := rd.ReadAt(p, 100<<10+5); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want[100<<10+5:100<<10+15], p)
+	assert.Equal(t, 1, counting.calls)
+
+	// seek then read to the end
+	pos, err := rd.Seek(-1000, io.SeekEnd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(want)-1000), pos)
+	got, err := ioutil.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want[len(want)-1000:], got)
+}
+
+func TestReaderInvalidLeaf(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	tree, _, err := merkle.Build(ctx, bytes.NewReader([]byte("0123456789abcdef")), st, merkle.WithBlobSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := st.PutBlob(ctx, tree.End.Start.HashSum, []byte("nope")); err != nil {
+		t.Fatal(err)
+	}
+
+	rd := tree.NewReader(ctx, st)
+	p := make([]byte, 4)
+	_, err = rd.ReadAt(p, 4)
+	assert.NoError(t, err)
+	assert.Equal(t, "4567", string(p))
+	_, err = rd.ReadAt(p, 8)
+	assert.Error(t, err)
+}
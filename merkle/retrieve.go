@@ -0,0 +1,250 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aybabtme/epher/thash"
+)
+
+// maxDepth is deeper than any tree built from data that fits in the
+// universe. Deeper trees are malformed, or loop back on themselves.
+const maxDepth = 64
+
+// MissingError is returned when sums of a tree can be found neither as
+// nodes nor as blobs.
+type MissingError struct {
+	Sums []thash.Sum
+}
+
+func (me *MissingError) Error() string {
+	if len(me.Sums) == 1 {
+		return fmt.Sprintf("sum %v of the tree is missing", me.Sums[0])
+	}
+	return fmt.Sprintf("%d sums of the tree are missing, like %v", len(me.Sums), me.Sums[0])
+}
+
+// RetrieveTree rebuilds the tree rooted in sum from the nodes and blobs
+// of store. The tree is fetched a level at a time, asking the store
+// about WithParallelism sums at once. Sums that are neither a node nor
+// a blob are reported in a *MissingError.
+//
+// The blobs under described nodes aren't fetched: their sizes come
+// from the nodes. Only the blobs under nodes that aren't described are
+// asked about, see Upgrade.
+func RetrieveTree(ctx context.Context, sum thash.Sum, store Store, opts ...Option) (*Tree, error) {
+	config := newConfig(opts)
+
+	var (
+		root     = &Tree{HashSum: sum}
+		level    = []probe{{tree: root}}
+		branches []*Tree // top down
+		missing  []thash.Sum
+		seen     = make(map[thash.Sum]bool)
+		depthOf  = make(map[thash.Sum]int) // of each node
+	)
+	for depth := 0; len(level) != 0; depth++ {
+		if depth == maxDepth {
+			return nil, errMalformedTree
+		}
+
+		nodes, blobs, err := fetchLevel(ctx, store, level, config.Parallelism)
+		if err != nil {
+			return nil, err
+		}
+		var next []probe
+		for _, p := range level {
+			tree := p.tree
+			if p.kind == BlobChild {
+				// sized by its parent
+				continue
+			}
+			if node, ok := nodes[tree.HashSum]; ok {
+				if d, ok := depthOf[tree.HashSum]; ok && d != depth {
+					// a node that contains itself
+					return nil, errMalformedTree
+				}
+				depthOf[tree.HashSum] = depth
+				tree.Start = &Tree{HashSum: node.Start, SizeByte: node.StartSize}
+				tree.End = &Tree{HashSum: node.End, SizeByte: node.EndSize}
+				branches = append(branches, tree)
+				next = append(next,
+					probe{tree: tree.Start, kind: node.StartKind},
+					probe{tree: tree.End, kind: node.EndKind},
+				)
+			} else if info, ok := blobs[tree.HashSum]; ok {
+				tree.SizeByte = info.Size
+			} else if !seen[tree.HashSum] {
+				seen[tree.HashSum] = true
+				missing = append(missing, tree.HashSum)
+			}
+		}
+		level = next
+	}
+	if len(missing) != 0 {
+		return nil, &MissingError{Sums: missing}
+	}
+
+	// children are always below their parent
+	for i := len(branches) - 1; i >= 0; i-- {
+		branch := branches[i]
+		branch.SizeByte = branch.Start.SizeByte + branch.End.SizeByte
+	}
+	return root, nil
+}
+
+// probe is a subtree whose sum must be asked about, and what its parent
+// says it is.
+type probe struct {
+	tree *Tree
+	kind ChildKind
+}
+
+// fetchLevel asks the store about the sums of a level of a tree that
+// aren't known to be blobs, first as nodes and then, for those that
+// aren't and could be blobs, as blobs.
+func fetchLevel(ctx context.Context, store Store, level []probe, parallelism int) (map[thash.Sum]Node, map[thash.Sum]BlobInfo, error) {
+	var (
+		sums      []thash.Sum
+		seen      = make(map[thash.Sum]bool, len(level))
+		maybeBlob = make(map[thash.Sum]bool)
+	)
+	for _, p := range level {
+		sum := p.tree.HashSum
+		switch p.kind {
+		case BlobChild:
+			continue
+		case UnknownChild:
+			maybeBlob[sum] = true
+		}
+		if !seen[sum] {
+			seen[sum] = true
+			sums = append(sums, sum)
+		}
+	}
+
+	var (
+		nodes     = make([]Node, len(sums))
+		nodeFound = make([]bool, len(sums))
+	)
+	err := forEach(ctx, len(sums), parallelism, func(ctx context.Context, i int) error {
+		var err error
+		nodes[i], nodeFound[i], err = store.GetNode(ctx, sums[i])
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var notNodes []thash.Sum
+	byNode := make(map[thash.Sum]Node)
+	for i, sum := range sums {
+		if nodeFound[i] {
+			byNode[sum] = nodes[i]
+		} else if maybeBlob[sum] {
+			notNodes = append(notNodes, sum)
+		}
+	}
+
+	var (
+		infos     = make([]BlobInfo, len(notNodes))
+		blobFound = make([]bool, len(notNodes))
+	)
+	err = forEach(ctx, len(notNodes), parallelism, func(ctx context.Context, i int) error {
+		var err error
+		infos[i], blobFound[i], err = store.InfoBlob(ctx, notNodes[i])
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	byBlob := make(map[thash.Sum]BlobInfo)
+	for i, sum := range notNodes {
+		if blobFound[i] {
+			byBlob[sum] = infos[i]
+		}
+	}
+	return byNode, byBlob, nil
+}
+
+// fetched is a leaf that was fetched ahead of being written.
+type fetched struct {
+	buf   bytes.Buffer
+	sum   thash.Sum
+	found bool
+	err   error
+	done  chan struct{}
+}
+
+// retrieveWindow fetches leaves concurrently, ahead of the one being
+// written, and writes them in order once verified.
+func (tree *Tree) retrieveWindow(ctx context.Context, wr io.Writer, store Store, config *config) (invalid []*Tree, err error) {
+	var leaves []*Tree
+	onBranch := func(branch *Tree) error {
+		got, err := config.branchSum(branch.Start, branch.End)
+		if err != nil || !branch.HashSum.Equal(got) {
+			invalid = append(invalid, branch)
+		}
+		return nil
+	}
+	onLeaf := func(leaf *Tree) error {
+		leaves = append(leaves, leaf)
+		return nil
+	}
+	if err := walk(tree, onBranch, onLeaf); err != nil {
+		return invalid, err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		ss      = Streaming(store)
+		budget  = newBudget(config.MaxInFlight)
+		fetches = make([]*fetched, len(leaves))
+		next    = 0
+	)
+	fetch := func(leaf *Tree) *fetched {
+		f := &fetched{done: make(chan struct{})}
+		go func() {
+			defer close(f.done)
+			h, err := config.blobHash(leaf.HashSum.Type, leaf.SizeByte)
+			if err != nil {
+				f.err = err
+				return
+			}
+			f.found, f.err = ss.GetBlobStream(ctx, leaf.HashSum, io.MultiWriter(&f.buf, h))
+			f.sum = thash.MakeSum(h)
+		}()
+		return f
+	}
+
+	for i, leaf := range leaves {
+		// the budget is empty once we get to the next leaf, so there's
+		// always room to fetch it
+		for next < len(leaves) && next < i+config.Parallelism && budget.tryAcquire(leaves[next].SizeByte) {
+			fetches[next] = fetch(leaves[next])
+			next++
+		}
+
+		f := fetches[i]
+		fetches[i] = nil
+		<-f.done
+		budget.release(leaf.SizeByte)
+
+		switch {
+		case f.err != nil:
+			return []*Tree{leaf}, f.err
+		case !f.found:
+			return []*Tree{leaf}, errDataMissing
+		case !leaf.HashSum.Equal(f.sum):
+			return []*Tree{leaf}, fmt.Errorf("want sum %x, got %x", leaf.HashSum.Sum, f.sum.Sum)
+		}
+		if _, err := wr.Write(f.buf.Bytes()); err != nil {
+			return invalid, err
+		}
+	}
+	return invalid, nil
+}
@@ -0,0 +1,253 @@
+package merkle_test
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/store"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetrieveParallel(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	want := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+	tree, _, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		window      = 8
+		maxInFlight = 20 << 10
+	)
+	slow := &slowStore{Store: st, delay: time.Millisecond}
+	buf := bytes.NewBuffer(nil)
+	invalid, err := tree.Retrieve(ctx, buf, slow,
+		merkle.WithParallelism(window),
+		merkle.WithMaxInFlight(maxInFlight),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Empty(t, invalid)
+	assert.Equal(t, want, buf.Bytes())
+
+	assert.True(t, slow.maxCalls > 1, "blobs weren't fetched concurrently")
+	assert.True(t, slow.maxCalls <= window, "%d blobs fetched at once", slow.maxCalls)
+	assert.True(t, slow.maxBytes <= maxInFlight, "%d bytes in flight", slow.maxBytes)
+}
+
+func TestRetrieveParallelInvalid(t *testing.T) {
+	ctx := context.Background()
+
+	want := []byte("0123456789abcdef")
+	for _, parallelism := range []int{1, 4} {
+		st := store.NewMemoryStore()
+		tree, _, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithBlobSize(4))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// corrupt the third leaf
+		leaf := tree.End.Start
+		if err := st.PutBlob(ctx, leaf.HashSum, []byte("nope")); err != nil {
+			t.Fatal(err)
+		}
+
+		buf := bytes.NewBuffer(nil)
+		invalid, err := tree.Retrieve(ctx, buf, st, merkle.WithParallelism(parallelism))
+		assert.Error(t, err, "parallelism %d", parallelism)
+		assert.Equal(t, []*merkle.Tree{leaf}, invalid, "parallelism %d", parallelism)
+		if parallelism > 1 {
+			// leaves fetched ahead are verified before they're written
+			assert.Equal(t, "01234567", buf.String())
+		}
+	}
+}
+
+func TestRetrieveTree(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	data := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+	want, sum, err := merkle.Build(ctx, bytes.NewReader(data), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, parallelism := range []int{1, 8} {
+		got, err := merkle.RetrieveTree(ctx, sum, st, merkle.WithParallelism(parallelism))
+		if err != nil {
+			t.Fatal(err)
+		}
+		assert.Equal(t, want, got, "parallelism %d", parallelism)
+	}
+}
+
+func TestRetrieveTreeMissing(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	tree, sum, err := merkle.Build(ctx, bytes.NewReader([]byte("0123456789abcdef")), st, merkle.WithBlobSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		hidden []thash.Sum
+	}{
+		{"root", []thash.Sum{sum}},
+		{"node", []thash.Sum{tree.Start.HashSum}},
+		{"blob", []thash.Sum{tree.End.Start.HashSum}},
+		{"many", []thash.Sum{tree.Start.HashSum, tree.End.End.HashSum}},
+	}
+	for _, tt := range tests {
+		// blobs are only asked about under nodes that don't describe them
+		hiding := &hidingStore{Store: st, hidden: tt.hidden, legacy: true}
+		got, err := merkle.RetrieveTree(ctx, sum, hiding)
+		assert.Nil(t, got, tt.name)
+		if me, ok := err.(*merkle.MissingError); assert.True(t, ok, "%s: %v", tt.name, err) {
+			assert.Equal(t, tt.hidden, me.Sums, tt.name)
+		}
+	}
+}
+
+func TestRetrieveTreeDescribed(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	data := make([]byte, 1<<20)
+	_, _ = rand.New(rand.NewSource(42)).Read(data)
+	want, sum, err := merkle.Build(ctx, bytes.NewReader(data), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	node, _, err := st.GetNode(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, node.Described())
+	assert.Equal(t, int64(len(data)), node.Size())
+
+	// sizes come from the nodes alone
+	counting := &hidingStore{Store: st}
+	got, err := merkle.RetrieveTree(ctx, sum, counting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, 0, counting.infos)
+
+	// nodes that don't describe their children can be upgraded
+	legacy := store.NewMemoryStore()
+	copyStore(t, &hidingStore{Store: st, legacy: true}, legacy, want)
+	counting = &hidingStore{Store: legacy}
+	got, err = merkle.RetrieveTree(ctx, sum, counting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, 256, counting.infos)
+
+	if _, err := merkle.Upgrade(ctx, sum, legacy); err != nil {
+		t.Fatal(err)
+	}
+	counting = &hidingStore{Store: legacy}
+	got, err = merkle.RetrieveTree(ctx, sum, counting)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+	assert.Equal(t, 0, counting.infos)
+}
+
+func TestRetrieveTreeLoop(t *testing.T) {
+	ctx := context.Background()
+	st := store.NewMemoryStore()
+
+	sum := thash.Sum{Type: thash.Blake2B512, Sum: "loop"}
+	leaf := thash.Sum{Type: thash.Blake2B512, Sum: "leaf"}
+	if err := st.PutNode(ctx, merkle.Node{Sum: sum, Start: sum, End: leaf}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := merkle.RetrieveTree(ctx, sum, st)
+	assert.Error(t, err)
+}
+
+// hidingStore pretends it doesn't have some nodes and blobs, or that
+// its nodes don't describe their children. It counts the blobs it's
+// asked about.
+type hidingStore struct {
+	merkle.Store
+	hidden []thash.Sum
+	legacy bool
+
+	mu    sync.Mutex
+	infos int
+}
+
+func (hs *hidingStore) isHidden(sum thash.Sum) bool {
+	for _, h := range hs.hidden {
+		if h.Equal(sum) {
+			return true
+		}
+	}
+	return false
+}
+
+func (hs *hidingStore) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
+	if hs.isHidden(sum) {
+		return merkle.Node{}, false, nil
+	}
+	node, found, err := hs.Store.GetNode(ctx, sum)
+	if hs.legacy {
+		node = merkle.Node{Sum: node.Sum, Start: node.Start, End: node.End}
+	}
+	return node, found, err
+}
+
+func (hs *hidingStore) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
+	hs.mu.Lock()
+	hs.infos++
+	hs.mu.Unlock()
+	if hs.isHidden(sum) {
+		return merkle.BlobInfo{}, false, nil
+	}
+	return hs.Store.InfoBlob(ctx, sum)
+}
+
+// copyStore copies the nodes and blobs of a tree from one store to
+// another.
+func copyStore(t *testing.T, from, to merkle.Store, tree *merkle.Tree) {
+	ctx := context.Background()
+	if tree.Start == nil {
+		data, _, err := from.GetBlob(ctx, tree.HashSum)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := to.PutBlob(ctx, tree.HashSum, data); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	node, _, err := from.GetNode(ctx, tree.HashSum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := to.PutNode(ctx, node); err != nil {
+		t.Fatal(err)
+	}
+	copyStore(t, from, to, tree.Start)
+	copyStore(t, from, to, tree.End)
+}
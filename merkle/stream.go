@@ -0,0 +1,59 @@
+package merkle
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/aybabtme/epher/thash"
+)
+
+// StreamStore is a Store that can move blobs without holding them
+// entirely in memory.
+type StreamStore interface {
+	Store
+	// PutBlobStream stores the `size` bytes read from r under sum.
+	PutBlobStream(ctx context.Context, sum thash.Sum, size int64, r io.Reader) error
+	// GetBlobStream writes the blob stored under sum to w.
+	GetBlobStream(ctx context.Context, sum thash.Sum, w io.Writer) (bool, error)
+}
+
+// Streaming returns a StreamStore for store. Stores that don't know
+// how to stream are adapted by buffering blobs in memory.
+func Streaming(store Store) StreamStore {
+	if ss, ok := store.(StreamStore); ok {
+		return ss
+	}
+	return &streamAdapter{Store: store}
+}
+
+type streamAdapter struct {
+	Store
+}
+
+func (sa *streamAdapter) PutBlobStream(ctx context.Context, sum thash.Sum, size int64, r io.Reader) error {
+	buf := bytes.NewBuffer(nil)
+	if err := CopyBlob(buf, r, size); err != nil {
+		return err
+	}
+	return sa.PutBlob(ctx, sum, buf.Bytes())
+}
+
+func (sa *streamAdapter) GetBlobStream(ctx context.Context, sum thash.Sum, w io.Writer) (bool, error) {
+	data, found, err := sa.GetBlob(ctx, sum)
+	if err != nil || !found {
+		return found, err
+	}
+	_, err = w.Write(data)
+	return true, err
+}
+
+// CopyBlob copies exactly size bytes from r to w. A reader that
+// ends early is reported as io.ErrUnexpectedEOF.
+func CopyBlob(w io.Writer, r io.Reader, size int64) error {
+	n, err := io.CopyN(w, r, size)
+	if err == io.EOF && n != size {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
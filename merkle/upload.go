@@ -0,0 +1,140 @@
+package merkle
+
+import (
+	"context"
+	"sync"
+
+	"github.com/aybabtme/epher/thash"
+)
+
+// uploader hashes and puts blobs and nodes in a store concurrently,
+// holding at most a budget of bytes of blobs in memory. The first
+// failure stops it.
+type uploader struct {
+	parent   context.Context
+	ctx      context.Context
+	cancel   func()
+	store    Store
+	config   *config
+	hashType thash.Type
+	budget   *budget
+
+	jobs chan upload
+	wg   sync.WaitGroup
+
+	errOnce sync.Once
+	err     error
+}
+
+type upload struct {
+	blob *pendingBlob
+	data []byte
+	node *Node
+}
+
+// pendingBlob is a blob being put. Its info is known once done is
+// closed, unless the upload failed.
+type pendingBlob struct {
+	info BlobInfo
+	done chan struct{}
+}
+
+func newUploader(ctx context.Context, store Store, config *config) *uploader {
+	up := &uploader{
+		parent:   ctx,
+		store:    store,
+		config:   config,
+		hashType: config.hashType(),
+		budget:   newBudget(config.MaxInFlight),
+		jobs:     make(chan upload),
+	}
+	up.ctx, up.cancel = context.WithCancel(ctx)
+	parallelism := config.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	for i := 0; i < parallelism; i++ {
+		up.wg.Add(1)
+		go up.work()
+	}
+	return up
+}
+
+func (up *uploader) work() {
+	defer up.wg.Done()
+	for u := range up.jobs {
+		if err := up.put(u); err != nil {
+			up.fail(err)
+		}
+		if u.blob != nil {
+			up.budget.release(int64(len(u.data)))
+			close(u.blob.done)
+		}
+	}
+}
+
+func (up *uploader) put(u upload) error {
+	if u.node != nil {
+		return up.store.PutNode(up.ctx, *u.node)
+	}
+	h, err := up.config.blobHash(up.hashType, int64(len(u.data)))
+	if err != nil {
+		return err
+	}
+	_, _ = h.Write(u.data)
+	sum := thash.MakeSum(h)
+	u.blob.info = BlobInfo{Sum: sum, Size: int64(len(u.data))}
+	return up.store.PutBlob(up.ctx, sum, u.data)
+}
+
+// putBlob queues a copy of data to be put. It returns false once the
+// upload is stopped.
+func (up *uploader) putBlob(data []byte) (*pendingBlob, bool) {
+	size := int64(len(data))
+	if err := up.budget.acquire(up.ctx, size); err != nil {
+		return nil, false
+	}
+	blob := &pendingBlob{done: make(chan struct{})}
+	if !up.queue(upload{blob: blob, data: append([]byte(nil), data...)}) {
+		up.budget.release(size)
+		return nil, false
+	}
+	return blob, true
+}
+
+// putNode queues a node to be put. It fails once the upload is
+// stopped.
+func (up *uploader) putNode(node Node) error {
+	if !up.queue(upload{node: &node}) {
+		return up.ctx.Err()
+	}
+	return nil
+}
+
+func (up *uploader) queue(u upload) bool {
+	select {
+	case up.jobs <- u:
+		return true
+	case <-up.ctx.Done():
+		return false
+	}
+}
+
+// stopped tells if the upload failed or was canceled.
+func (up *uploader) stopped() bool { return up.ctx.Err() != nil }
+
+func (up *uploader) fail(err error) {
+	up.errOnce.Do(func() { up.err = err })
+	up.cancel()
+}
+
+// wait for the queued blobs to be put, returning the first error.
+func (up *uploader) wait() error {
+	close(up.jobs)
+	up.wg.Wait()
+	up.cancel()
+	if up.err != nil {
+		return up.err
+	}
+	return up.parent.Err()
+}
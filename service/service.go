@@ -1,9 +1,14 @@
 package service
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"math/rand"
 	"net"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/aybabtme/epher/cluster"
 	"github.com/aybabtme/epher/codec"
@@ -14,40 +19,130 @@ import (
 
 type Svc interface {
 	Store() merkle.Store
+	Addr() net.Addr
 	Close() error
 }
 
 type Dialer func(cluster.Node) merkle.Store
 
-func Start(r *rand.Rand, rc cluster.RemoteCluster, codec codec.Codec, local merkle.Store, dialFn Dialer) (Svc, error) {
+type Option func(*config)
+
+type config struct {
+	Port        int
+	Replication store.Quorum
+	RepairEvery time.Duration
+	Verify      []store.VerifyOption
+	TLS         *tls.Config
+	Tokens      store.TokenStore
+}
+
+func newConfig(opts []Option) *config {
+	def := &config{
+		Port:        0, // any free port
+		Replication: store.Quorum{N: 1, W: 1, R: 1},
+		RepairEvery: time.Minute,
+	}
+	for _, o := range opts {
+		o(def)
+	}
+	return def
+}
+
+// WithPort sets the port on which the service listens for RPCs.
+func WithPort(port int) Option { return func(opts *config) { opts.Port = port } }
+
+// WithReplication sets how many members of the cluster keep a copy of
+// each sum, and the quorums needed to write and read them.
+func WithReplication(q store.Quorum) Option { return func(opts *config) { opts.Replication = q } }
+
+// WithTLS serves RPCs over TLS. The config can require that clients
+// present a certificate, so only members of the cluster can talk to
+// the service: see store.TLSConfigs.
+func WithTLS(tlsConfig *tls.Config) Option { return func(opts *config) { opts.TLS = tlsConfig } }
+
+// WithAuth only serves RPCs that bear a token known to tokens, with the
+// scope they need: see store.Authenticate. Peers must then be dialed
+// with a token that has store.PeerScope.
+func WithAuth(tokens store.TokenStore) Option { return func(opts *config) { opts.Tokens = tokens } }
+
+// WithVerification configures how the service verifies that what it's
+// sent matches its sum.
+func WithVerification(verify ...store.VerifyOption) Option {
+	return func(opts *config) { opts.Verify = verify }
+}
+
+// WithRepairInterval sets how often the replicas held by the local
+// store are repaired. Repairs are disabled if it's 0, or if the local
+// store can't list what it holds. Otherwise, the dialer must return
+// store.RepairPeers.
+func WithRepairInterval(every time.Duration) Option {
+	return func(opts *config) { opts.RepairEvery = every }
+}
+
+func Start(r *rand.Rand, rc cluster.RemoteCluster, codec codec.Codec, local merkle.Store, dialFn Dialer, opts ...Option) (Svc, error) {
+
+	config := newConfig(opts)
+	if err := config.Replication.Validate(); err != nil {
+		return nil, err
+	}
 
 	var l net.Listener
 	lc, err := rc.Join(func(ip string) (net.Addr, error) {
 		var err error
-		l, err = net.Listen("tcp", ip+":0")
+		l, err = net.Listen("tcp", net.JoinHostPort(ip, strconv.Itoa(config.Port)))
 		if err != nil {
 			return nil, err
 		}
 		return l.Addr(), nil
 	})
 	if err != nil {
+		if l != nil {
+			_ = l.Close()
+		}
 		return nil, err
 	}
 
-	// we want to serve from our local store if we can
-	// otherwise we'll do a random search with our neighbours
-	// TODO: use informed search instead of random search
+	if config.TLS != nil {
+		l = tls.NewListener(l, config.TLS)
+	}
+
+	// we want to serve from the nodes that own the data, which
+	// might include us. data that was put before the members of
+	// the cluster changed may be elsewhere, so we then look in our
+	// local store and finally do a random search with our neighbours
 
-	pool := store.ClusterPool(lc, dialFn)
+	lister, canList := local.(store.ListStore)
 	local = store.Log(log.KV("store", "local"), local)
+	self := lc.Self()
+	repairs := canList && config.RepairEvery > 0
+	if _, ok := dialFn(self).(store.RepairPeer); repairs && !ok {
+		_ = lc.Leave()
+		_ = l.Close()
+		return nil, errors.New("can't repair replicas, the dialer doesn't return a store.RepairPeer")
+	}
+	cpool := store.NewClusterPool(lc, func(nd cluster.Node) merkle.Store {
+		if nd == self {
+			return local
+		}
+		return store.Forward(dialFn(nd))
+	})
+	pool := cpool.Pool()
 
+	replicated := store.Log(
+		log.KV("store", "replicated"),
+		store.Replicated(cpool, config.Replication),
+	)
 	aggregate := store.Log(
 		log.KV("store", "singleflight"),
 		store.SingleFlight(
 			store.Log(
 				log.KV("store", "layer"),
-				store.Layer(
-					// first ping our local store
+				// writes only go to the owners, so that they
+				// fail when a quorum can't be met
+				store.ReadThrough(
+					// first ping the owners of the data
+					replicated,
+					// then our local store
 					local,
 					// then ping a few people
 					store.Log(
@@ -70,13 +165,36 @@ func Start(r *rand.Rand, rc cluster.RemoteCluster, codec codec.Codec, local merk
 		),
 	)
 
+	// the children of nodes are checked where they'd be put, not
+	// by searching the whole cluster for them
+	verifyOpts := append([]store.VerifyOption{
+		store.VerifyChildrenIn(store.ByOrigin(local, store.Layer(replicated, local))),
+	}, config.Verify...)
+
+	var srvOpts []store.ServerOption
+	if config.Tokens != nil {
+		srvOpts = append(srvOpts, store.Authenticate(config.Tokens))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	if repairs {
+		repairer := store.NewRepairer(cpool, lister, config.Replication.N, cpool.Peer)
+		srvOpts = append(srvOpts, store.ServeRepairs(repairer))
+		go repairer.Run(ctx, config.RepairEvery)
+	}
+
 	svc := &service{
-		local:   aggregate,
-		cluster: lc,
+		local:        aggregate,
+		cluster:      lc,
+		pool:         cpool,
+		stopRepairer: cancel,
 		srv: &http.Server{
 			Handler: store.HTTPServer(
 				codec,
-				aggregate,
+				// peers only ask for what we have, so that
+				// requests can't bounce around the cluster.
+				// nothing is stored unless it matches its sum
+				store.Verify(store.ByOrigin(local, aggregate), verifyOpts...),
+				srvOpts...,
 			),
 		},
 		l: l,
@@ -90,24 +208,30 @@ func Start(r *rand.Rand, rc cluster.RemoteCluster, codec codec.Codec, local merk
 type service struct {
 	local   merkle.Store
 	cluster cluster.Cluster
+	pool    *store.ClusterPool
 	srv     *http.Server
 
+	stopRepairer func()
+
 	l net.Listener
 }
 
 func (svc *service) Store() merkle.Store { return svc.local }
+func (svc *service) Addr() net.Addr      { return svc.l.Addr() }
 
 func (svc *service) Close() error {
 	if svc.cluster == nil {
 		panic("ugh")
 	}
+	svc.stopRepairer()
+	svc.pool.Close()
 	if err := svc.cluster.Leave(); err != nil {
 		_ = svc.l.Close()
 		return err
 	}
-	if err := svc.srv.Close(); err != nil {
-		_ = svc.l.Close()
-		return err
-	}
-	return svc.l.Close()
+	err := svc.srv.Close()
+	// the server already closed the listener, unless it had not yet
+	// started serving on it
+	_ = svc.l.Close()
+	return err
 }
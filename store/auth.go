@@ -0,0 +1,163 @@
+package store
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Scope is what the bearer of a token may do.
+type Scope uint8
+
+const (
+	// ReadScope gets nodes and blobs.
+	ReadScope Scope = 1 << iota
+	// WriteScope puts nodes and blobs.
+	WriteScope
+	// PeerScope is for the nodes of the cluster: it forwards requests
+	// and repairs replicas.
+	PeerScope
+)
+
+var scopeNames = []string{"read", "write", "peer"}
+
+func (s Scope) String() string {
+	var names []string
+	for i, name := range scopeNames {
+		if s&(1<<uint(i)) != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseScope parses scopes separated by commas, like "read,write".
+func ParseScope(str string) (Scope, error) {
+	var s Scope
+	for _, name := range strings.Split(str, ",") {
+		i := 0
+		for i < len(scopeNames) && scopeNames[i] != name {
+			i++
+		}
+		if i == len(scopeNames) {
+			return 0, fmt.Errorf("unknown scope %q", name)
+		}
+		s |= 1 << uint(i)
+	}
+	return s, nil
+}
+
+// TokenStore tells what the bearer of a token may do.
+type TokenStore interface {
+	// Scope of token, not found if the token isn't known.
+	Scope(ctx context.Context, token string) (Scope, bool, error)
+}
+
+// StaticTokens is a TokenStore of a fixed set of tokens.
+type StaticTokens map[string]Scope
+
+func (st StaticTokens) Scope(ctx context.Context, token string) (Scope, bool, error) {
+	// compare with every token, so the time taken doesn't tell how
+	// close a guess is
+	var (
+		scope Scope
+		found bool
+	)
+	for known, s := range st {
+		if subtle.ConstantTimeCompare([]byte(known), []byte(token)) == 1 {
+			scope, found = s, true
+		}
+	}
+	return scope, found, nil
+}
+
+// LoadTokens reads tokens from a file with one token per line,
+// followed by its scopes:
+//
+//	<token> read,write
+//
+// Empty lines and lines starting with '#' are ignored.
+func LoadTokens(filename string) (StaticTokens, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readTokens(f)
+}
+
+func readTokens(r io.Reader) (StaticTokens, error) {
+	tokens := make(StaticTokens)
+	scan := bufio.NewScanner(r)
+	for line := 1; scan.Scan(); line++ {
+		fields := strings.Fields(scan.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("line %d: want a token and its scopes", line)
+		}
+		scope, err := ParseScope(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		tokens[fields[0]] = scope
+	}
+	return tokens, scan.Err()
+}
+
+// requiredScope is the scope needed to serve a request. Requests
+// forwarded by peers and repairs need PeerScope, so clients can't pass
+// for members of the cluster.
+func requiredScope(r *http.Request) Scope {
+	var need Scope
+	switch r.Method {
+	case "GET", "HEAD":
+		need = ReadScope
+	default:
+		need = WriteScope
+	}
+	if r.Header.Get(forwardedHeader) != "" || strings.HasPrefix(r.URL.Path, "/v1/repair") {
+		need |= PeerScope
+	}
+	return need
+}
+
+// authenticate serves requests with h if they bear a token that has
+// the scope they need.
+func authenticate(tokens TokenStore, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const prefix = "Bearer "
+		auth := r.Header.Get("Authorization")
+		if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "missing bearer token")
+			return
+		}
+		scope, found, err := tokens.Scope(r.Context(), auth[len(prefix):])
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprintf(w, "%v", err)
+			return
+		}
+		if !found {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, "unknown token")
+			return
+		}
+		if need := requiredScope(r); scope&need != need {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer error="insufficient_scope", scope=%q`, strings.Replace(need.String(), ",", " ", -1)))
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintf(w, "token has scopes %q, needs %q", scope, need)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
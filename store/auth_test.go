@@ -0,0 +1,91 @@
+package store
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStoreAuth(t *testing.T) {
+	tokens := StaticTokens{"rw": ReadScope | WriteScope}
+
+	var srvs []*httptest.Server
+	defer func() {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}()
+	testStore(t, func() merkle.Store {
+		srv := httptest.NewServer(HTTPServer(codec.Binary(), NewMemoryStore(), Authenticate(tokens)))
+		srvs = append(srvs, srv)
+		return httpClient(t, strings.TrimPrefix(srv.URL, "http://"), codec.Binary(), &http.Client{}, ClientToken("rw"))
+	})
+}
+
+func TestHTTPStoreScopes(t *testing.T) {
+	ctx := context.Background()
+	tokens := StaticTokens{
+		"reader": ReadScope,
+		"writer": ReadScope | WriteScope,
+		"peer":   ReadScope | WriteScope | PeerScope,
+	}
+	srv := httptest.NewServer(HTTPServer(codec.Binary(), NewMemoryStore(), Authenticate(tokens)))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	client := func(opts ...ClientOption) merkle.Store {
+		return httpClient(t, addr, codec.Binary(), &http.Client{}, opts...)
+	}
+	sum := helloSum()
+
+	for _, cl := range []merkle.Store{client(), client(ClientToken("nope"))} {
+		_, _, err := cl.InfoBlob(ctx, sum)
+		assert.Error(t, err)
+		assert.Error(t, cl.PutBlob(ctx, sum, []byte("hello world")))
+	}
+
+	reader := client(ClientToken("reader"))
+	_, found, err := reader.InfoBlob(ctx, sum)
+	assert.NoError(t, err)
+	assert.False(t, found)
+	assert.Error(t, reader.PutBlob(ctx, sum, []byte("hello world")))
+
+	writer := client(ClientToken("writer"))
+	assert.NoError(t, writer.PutBlob(ctx, sum, []byte("hello world")))
+
+	// only peers forward requests
+	_, _, err = Forward(writer).InfoBlob(ctx, sum)
+	assert.Error(t, err)
+	_, found, err = Forward(client(ClientToken("peer"))).InfoBlob(ctx, sum)
+	assert.NoError(t, err)
+	assert.True(t, found)
+}
+
+func TestReadTokens(t *testing.T) {
+	tokens, err := readTokens(strings.NewReader(`
+# clients
+abc read
+def read,write
+
+ghi read,write,peer
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, StaticTokens{
+		"abc": ReadScope,
+		"def": ReadScope | WriteScope,
+		"ghi": ReadScope | WriteScope | PeerScope,
+	}, tokens)
+	assert.Equal(t, "read,write,peer", tokens["ghi"].String())
+
+	_, err = readTokens(strings.NewReader("abc admin\n"))
+	assert.Error(t, err)
+	_, err = readTokens(strings.NewReader("abc\n"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,86 @@
+package store
+
+import (
+	"context"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// forwardedHeader marks RPCs that a node sends to its peers on behalf
+// of its own clients.
+const forwardedHeader = "Epher-Forwarded"
+
+type forwardedKey struct{}
+
+func withForwarded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, forwardedKey{}, true)
+}
+
+// IsForwarded tells if a request was forwarded by a peer.
+func IsForwarded(ctx context.Context) bool {
+	fwd, _ := ctx.Value(forwardedKey{}).(bool)
+	return fwd
+}
+
+// Forward marks all the requests sent to store as forwarded on behalf
+// of another node. The mark travels over RPCs. If store is a
+// RepairPeer, so is the store it returns.
+func Forward(store merkle.Store) merkle.Store {
+	fwd := &intercept{
+		around: func(ctx context.Context, method string, fn func(context.Context) error) error {
+			return fn(withForwarded(ctx))
+		},
+		wrap: store,
+	}
+	if peer, ok := store.(RepairPeer); ok {
+		// repairs are only ever asked of peers, they don't need
+		// the mark
+		return &forwardPeer{intercept: fwd, RepairPeer: peer}
+	}
+	return fwd
+}
+
+type forwardPeer struct {
+	*intercept
+	RepairPeer
+}
+
+// ByOrigin serves the requests forwarded by peers with one store, and
+// all other requests with another. Nodes serving forwarded requests
+// only from their own data can't forward them back and forth.
+func ByOrigin(forwarded, direct merkle.Store) merkle.Store {
+	return &byOrigin{forwarded: forwarded, direct: direct}
+}
+
+type byOrigin struct {
+	forwarded merkle.Store
+	direct    merkle.Store
+}
+
+func (bo *byOrigin) pick(ctx context.Context) merkle.Store {
+	if IsForwarded(ctx) {
+		return bo.forwarded
+	}
+	return bo.direct
+}
+
+func (bo *byOrigin) PutNode(ctx context.Context, node merkle.Node) error {
+	return bo.pick(ctx).PutNode(ctx, node)
+}
+
+func (bo *byOrigin) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
+	return bo.pick(ctx).GetNode(ctx, sum)
+}
+
+func (bo *byOrigin) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	return bo.pick(ctx).PutBlob(ctx, sum, data)
+}
+
+func (bo *byOrigin) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	return bo.pick(ctx).GetBlob(ctx, sum)
+}
+
+func (bo *byOrigin) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
+	return bo.pick(ctx).InfoBlob(ctx, sum)
+}
@@ -0,0 +1,219 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// FSStore persists nodes and blobs to a directory. Each entry is
+// written to a content-addressed path, sharded by the prefix of its
+// hash sum:
+//
+//	<dir>/blobs/<type>/<hex[:2]>/<hex>
+//	<dir>/nodes/<type>/<hex[:2]>/<hex>
+//
+// Writes are atomic: data is first written to a temporary file which
+// is then renamed in place, so a crash never leaves a partial entry.
+type FSStore struct {
+	dir   string
+	codec codec.Codec
+}
+
+// NewFSStore opens or creates a store rooted in dir. Leftovers of
+// writes interrupted by a crash are cleaned up.
+func NewFSStore(dir string) (merkle.StreamStore, error) {
+	fs := &FSStore{dir: dir, codec: codec.Binary()}
+	if err := os.RemoveAll(filepath.Join(dir, "tmp")); err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{"blobs", "nodes", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return fs, nil
+}
+
+func (fs *FSStore) path(kind string, sum thash.Sum) string {
+	hexsum := hex.EncodeToString([]byte(sum.Sum))
+	shard := "_"
+	if len(hexsum) >= 2 {
+		shard = hexsum[:2]
+	}
+	return filepath.Join(fs.dir, kind, fmt.Sprintf("%d", sum.Type), shard, hexsum)
+}
+
+func (fs *FSStore) PutNode(ctx context.Context, node merkle.Node) error {
+	buf := bytes.NewBuffer(nil)
+	if err := fs.codec.EncodeNode(buf, node); err != nil {
+		return err
+	}
+	path := fs.path("nodes", node.Sum)
+	if !node.Described() {
+		return fs.write(path, int64(buf.Len()), buf)
+	}
+	// replace nodes that were written before they described their
+	// children, or that described them differently
+	old, found, err := fs.GetNode(ctx, node.Sum)
+	if err != nil {
+		return err
+	}
+	if found && old == node {
+		return nil
+	}
+	return fs.create(path, int64(buf.Len()), buf)
+}
+
+func (fs *FSStore) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
+	f, err := os.Open(fs.path("nodes", sum))
+	if os.IsNotExist(err) {
+		return merkle.Node{}, false, nil
+	}
+	if err != nil {
+		return merkle.Node{}, false, err
+	}
+	defer f.Close()
+	var node merkle.Node
+	if err := fs.codec.DecodeNode(f, &node); err != nil {
+		return merkle.Node{}, false, err
+	}
+	return node, true, nil
+}
+
+func (fs *FSStore) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	return fs.write(fs.path("blobs", sum), int64(len(data)), bytes.NewReader(data))
+}
+
+func (fs *FSStore) PutBlobStream(ctx context.Context, sum thash.Sum, size int64, r io.Reader) error {
+	return fs.write(fs.path("blobs", sum), size, r)
+}
+
+func (fs *FSStore) GetBlobStream(ctx context.Context, sum thash.Sum, w io.Writer) (bool, error) {
+	f, err := os.Open(fs.path("blobs", sum))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return true, err
+}
+
+func (fs *FSStore) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	data, err := ioutil.ReadFile(fs.path("blobs", sum))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (fs *FSStore) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
+	fi, err := os.Stat(fs.path("blobs", sum))
+	if os.IsNotExist(err) {
+		return merkle.BlobInfo{}, false, nil
+	}
+	if err != nil {
+		return merkle.BlobInfo{}, false, err
+	}
+	return merkle.BlobInfo{Sum: sum, Size: fi.Size()}, true, nil
+}
+
+func (fs *FSStore) List(ctx context.Context, fn func(Entry) error) error {
+	for _, kind := range []Kind{BlobKind, NodeKind} {
+		root := filepath.Join(fs.dir, kind.String()+"s")
+		err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if fi.IsDir() {
+				return nil
+			}
+			// <kind>/<type>/<hex[:2]>/<hex>
+			typeDir := filepath.Base(filepath.Dir(filepath.Dir(path)))
+			typ, err := strconv.ParseUint(typeDir, 10, 16)
+			if err != nil {
+				return fmt.Errorf("unexpected file in store: %q", path)
+			}
+			raw, err := hex.DecodeString(fi.Name())
+			if err != nil {
+				return fmt.Errorf("unexpected file in store: %q", path)
+			}
+			return fn(Entry{Kind: kind, Sum: thash.Sum{Type: thash.Type(typ), Sum: string(raw)}})
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// write atomically creates the file at path with the size bytes read
+// from r. Since paths are content-addressed, an existing file already
+// holds the right content and is left untouched.
+func (fs *FSStore) write(path string, size int64, r io.Reader) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	}
+	return fs.create(path, size, r)
+}
+
+// create writes the file at path, replacing what was there.
+func (fs *FSStore) create(path string, size int64, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Join(fs.dir, "tmp"), "put-")
+	if err != nil {
+		return err
+	}
+	if err := merkle.CopyBlob(tmp, r, size); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,80 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFSStore(t *testing.T) {
+	var dirs []string
+	defer func() {
+		for _, dir := range dirs {
+			_ = os.RemoveAll(dir)
+		}
+	}()
+	mkStore := func() merkle.Store {
+		dir, err := ioutil.TempDir("", "epher_fs_store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dirs = append(dirs, dir)
+		return mustFSStore(t, dir)
+	}
+	testStore(t, mkStore)
+	testStoreReplaceNode(t, mkStore())
+}
+
+func TestFSStoreSurvivesRestart(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "epher_fs_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	want := []byte("123456789")
+
+	_, sum, err := merkle.Build(
+		ctx,
+		bytes.NewReader(want),
+		mustFSStore(t, dir),
+		merkle.WithBlobSize(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the directory, as a restarted process would
+	store := mustFSStore(t, dir)
+
+	tree, err := merkle.RetrieveTree(ctx, sum, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, int64(len(want)), tree.SizeByte)
+
+	buf := bytes.NewBuffer(nil)
+	invalid, err := tree.Retrieve(ctx, buf, store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(invalid) != 0 {
+		t.Fatal(invalid)
+	}
+	assert.Equal(t, want, buf.Bytes())
+}
+
+func mustFSStore(t *testing.T, dir string) merkle.Store {
+	store, err := NewFSStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store
+}
@@ -0,0 +1,45 @@
+package store
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+	"github.com/julienschmidt/httprouter"
+)
+
+// GetObject serves the data of the tree rooted in a sum, for plain
+// HTTP clients. Range, If-Range and If-None-Match requests are
+// honored. The root sum is the object's strong ETag and, since objects
+// never change, they can be cached forever.
+func (rpc *rpcServer) GetObject(w http.ResponseWriter, r *http.Request, ps httprouter.Params) {
+	ctx := r.Context()
+
+	sum, err := thash.ParseSum(ps.ByName("sum"))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	tree, err := merkle.RetrieveTree(ctx, sum, rpc.store)
+	if me, ok := err.(*merkle.MissingError); ok && me.Sums[0] == sum {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	h := w.Header()
+	h.Set("ETag", `"`+sum.String()+`"`)
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	// don't let the content be sniffed, it would fetch the first leaf
+	// of every request
+	h.Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, "", time.Time{}, tree.NewReader(ctx, rpc.store))
+}
@@ -0,0 +1,94 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetObject(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStore()
+
+	want := make([]byte, 100<<10)
+	_, _ = rand.New(rand.NewSource(42)).Read(want)
+	_, sum, err := merkle.Build(ctx, bytes.NewReader(want), st, merkle.WithBlobSize(4<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(HTTPServer(codec.Binary(), st))
+	defer srv.Close()
+	url := srv.URL + "/v1/objects/" + sum.String()
+	etag := `"` + sum.String() + `"`
+
+	get := func(method string, headers ...string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resp, body
+	}
+
+	resp, body := get("GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+	assert.Equal(t, want, body)
+
+	resp, body = get("HEAD")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(want)), resp.ContentLength)
+	assert.Empty(t, body)
+
+	resp, body = get("GET", "Range", "bytes=5000-9999")
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 5000-9999/102400", resp.Header.Get("Content-Range"))
+	assert.Equal(t, want[5000:10000], body)
+
+	resp, body = get("GET", "Range", "bytes=-100", "If-Range", etag)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, want[len(want)-100:], body)
+
+	resp, _ = get("GET", "If-None-Match", etag)
+	assert.Equal(t, http.StatusNotModified, resp.StatusCode)
+
+	resp, _ = get("GET", "Range", "bytes=200000-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, resp.StatusCode)
+
+	// sums in the form printed by older command lines
+	url = fmt.Sprintf("%s/v1/objects/%d:%x", srv.URL, sum.Type, sum.Sum)
+	resp, body = get("GET")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, etag, resp.Header.Get("ETag"))
+	assert.Equal(t, want, body)
+
+	url = srv.URL + "/v1/objects/1:0123"
+	resp, _ = get("GET")
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	url = srv.URL + "/v1/objects/nope"
+	resp, _ = get("GET")
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
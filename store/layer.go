@@ -81,3 +81,27 @@ func (ly *layered) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo
 	})
 	return info, found, err
 }
+
+// ReadThrough writes only to the first store, but reads from all of
+// them in order, like Layer. Errors from the first store are returned
+// as is, instead of falling through to stores that would accept any
+// write.
+func ReadThrough(first merkle.Store, fallbacks ...merkle.Store) merkle.Store {
+	return &readThrough{
+		layered: &layered{inOrder: append([]merkle.Store{first}, fallbacks...)},
+		first:   first,
+	}
+}
+
+type readThrough struct {
+	*layered
+	first merkle.Store
+}
+
+func (rt *readThrough) PutNode(ctx context.Context, node merkle.Node) error {
+	return rt.first.PutNode(ctx, node)
+}
+
+func (rt *readThrough) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	return rt.first.PutBlob(ctx, sum, data)
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// Kind tells apart the blobs and the nodes held by a store.
+type Kind uint8
+
+const (
+	BlobKind Kind = iota
+	NodeKind
+)
+
+func (k Kind) String() string {
+	switch k {
+	case BlobKind:
+		return "blob"
+	case NodeKind:
+		return "node"
+	}
+	return "Kind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// Entry is a blob or a node held by a store.
+type Entry struct {
+	Kind Kind
+	Sum  thash.Sum
+}
+
+// A Lister can enumerate what it holds.
+type Lister interface {
+	// List calls fn with every entry of the store, in no particular
+	// order. Listing stops at the first error returned by fn.
+	List(ctx context.Context, fn func(Entry) error) error
+}
+
+// ListStore is a merkle.Store that can enumerate what it holds.
+type ListStore interface {
+	merkle.Store
+	Lister
+}
@@ -43,7 +43,6 @@ func (lb *loadBalance) pick(ctx context.Context, fn func(ctx context.Context, st
 			return true
 		}
 	}
-	return false
 }
 
 func (lb *loadBalance) PutNode(ctx context.Context, node merkle.Node) error {
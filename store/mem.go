@@ -2,30 +2,71 @@ package store
 
 import (
 	"context"
+	"sync"
+	"sync/atomic"
 
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/epher/thash"
 )
 
+// memShards is the number of independently locked partitions of a
+// MemoryStore. Sums are spread over them by their first byte.
+const memShards = 256
+
+// MemoryStore keeps nodes and blobs in memory. It is safe for
+// concurrent use.
 type MemoryStore struct {
+	shards [memShards]memShard
+
+	sizeByte int64 // atomic
+}
+
+type memShard struct {
+	mu   sync.RWMutex
 	node map[thash.Sum]merkle.Node
 	data map[thash.Sum][]byte
 }
 
 func NewMemoryStore() merkle.Store {
-	return &MemoryStore{
-		node: make(map[thash.Sum]merkle.Node),
-		data: make(map[thash.Sum][]byte),
+	mem := new(MemoryStore)
+	for i := range mem.shards {
+		mem.shards[i] = memShard{
+			node: make(map[thash.Sum]merkle.Node),
+			data: make(map[thash.Sum][]byte),
+		}
 	}
+	return mem
+}
+
+func (mem *MemoryStore) shard(sum thash.Sum) *memShard {
+	if len(sum.Sum) == 0 {
+		return &mem.shards[0]
+	}
+	return &mem.shards[sum.Sum[0]]
+}
+
+// SizeByte is the total size of the blobs held in the store.
+func (mem *MemoryStore) SizeByte() int64 {
+	return atomic.LoadInt64(&mem.sizeByte)
 }
 
 func (mem *MemoryStore) PutNode(ctx context.Context, node merkle.Node) error {
-	mem.node[node.Sum] = node
+	sh := mem.shard(node.Sum)
+	sh.mu.Lock()
+	// described nodes replace what was there, undescribed ones never
+	// replace described ones
+	if old, ok := sh.node[node.Sum]; !ok || !old.Described() || node.Described() {
+		sh.node[node.Sum] = node
+	}
+	sh.mu.Unlock()
 	return nil
 }
 
 func (mem *MemoryStore) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
-	node, ok := mem.node[sum]
+	sh := mem.shard(sum)
+	sh.mu.RLock()
+	node, ok := sh.node[sum]
+	sh.mu.RUnlock()
 	if !ok {
 		return merkle.Node{}, false, nil
 	}
@@ -35,19 +76,62 @@ func (mem *MemoryStore) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node
 func (mem *MemoryStore) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
 	cp := make([]byte, len(data))
 	copy(cp, data)
-	mem.data[sum] = cp
+
+	sh := mem.shard(sum)
+	sh.mu.Lock()
+	old, ok := sh.data[sum]
+	sh.data[sum] = cp
+	sh.mu.Unlock()
+
+	delta := int64(len(cp))
+	if ok {
+		delta -= int64(len(old))
+	}
+	atomic.AddInt64(&mem.sizeByte, delta)
 	return nil
 }
 
 func (mem *MemoryStore) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
-	data, ok := mem.data[sum]
+	sh := mem.shard(sum)
+	sh.mu.RLock()
+	data, ok := sh.data[sum]
+	sh.mu.RUnlock()
 	return data, ok, nil
 }
 
 func (mem *MemoryStore) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
-	data, ok := mem.data[sum]
+	sh := mem.shard(sum)
+	sh.mu.RLock()
+	data, ok := sh.data[sum]
+	sh.mu.RUnlock()
 	if !ok {
 		return merkle.BlobInfo{}, false, nil
 	}
 	return merkle.BlobInfo{Size: int64(len(data)), Sum: sum}, true, nil
 }
+
+func (mem *MemoryStore) List(ctx context.Context, fn func(Entry) error) error {
+	for i := range mem.shards {
+		// don't hold the lock while calling fn, it might write to us
+		sh := &mem.shards[i]
+		sh.mu.RLock()
+		entries := make([]Entry, 0, len(sh.node)+len(sh.data))
+		for sum := range sh.node {
+			entries = append(entries, Entry{Kind: NodeKind, Sum: sum})
+		}
+		for sum := range sh.data {
+			entries = append(entries, Entry{Kind: BlobKind, Sum: sum})
+		}
+		sh.mu.RUnlock()
+
+		for _, e := range entries {
+			if err := fn(e); err != nil {
+				return err
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,5 +1,74 @@
 package store
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
 
-func TestMemoryStore(t *testing.T) { testStore(t, NewMemoryStore) }
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryStore(t *testing.T) {
+	testStore(t, NewMemoryStore)
+	testStoreReplaceNode(t, NewMemoryStore())
+}
+
+func TestMemoryStoreConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	store := NewMemoryStore().(*MemoryStore)
+
+	const (
+		writers = 16
+		blobs   = 200
+	)
+
+	var (
+		wg      sync.WaitGroup
+		errc    = make(chan error, writers)
+		wantTot int64
+	)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < blobs; i++ {
+				// every writer puts the same blobs, so they collide
+				sum, data := makeMemBlob(i)
+				if err := store.PutBlob(ctx, sum, data); err != nil {
+					errc <- err
+					return
+				}
+				got, found, err := store.GetBlob(ctx, sum)
+				if err != nil {
+					errc <- err
+					return
+				}
+				if !found || !bytes.Equal(data, got) {
+					errc <- fmt.Errorf("writer %d: blob %d: found=%v, got %q", w, i, found, got)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(errc)
+	for err := range errc {
+		t.Error(err)
+	}
+
+	for i := 0; i < blobs; i++ {
+		_, data := makeMemBlob(i)
+		wantTot += int64(len(data))
+	}
+	assert.Equal(t, wantTot, store.SizeByte())
+}
+
+func makeMemBlob(i int) (thash.Sum, []byte) {
+	data := []byte(fmt.Sprintf("blob number %d", i))
+	h, _ := thash.New(thash.Blake2B512)
+	_, _ = h.Write(data)
+	return thash.MakeSum(h), data
+}
@@ -0,0 +1,46 @@
+package store
+
+import (
+	"errors"
+	"hash/fnv"
+	"sort"
+
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/thash"
+)
+
+var errNoOwner = errors.New("no member of the cluster owns this sum")
+
+// Owners picks the n nodes that own a sum, using rendezvous hashing:
+// every node is scored with a hash of itself and the sum, and the n
+// best scores win. Nodes are returned best first. All nodes that
+// agree on the members of a cluster agree on the owners of a sum, and
+// a member joining or leaving only moves the sums it owns.
+func Owners(sum thash.Sum, nodes []cluster.Node, n int) []cluster.Node {
+	type scored struct {
+		node  cluster.Node
+		score uint64
+	}
+	all := make([]scored, 0, len(nodes))
+	for _, nd := range nodes {
+		h := fnv.New64a()
+		_, _ = h.Write([]byte(nd.Addr))
+		_, _ = h.Write([]byte{0})
+		_, _ = h.Write([]byte(sum.Sum))
+		all = append(all, scored{node: nd, score: h.Sum64()})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].score != all[j].score {
+			return all[i].score > all[j].score
+		}
+		return all[i].node.Addr < all[j].node.Addr
+	})
+	if n > len(all) {
+		n = len(all)
+	}
+	owners := make([]cluster.Node, 0, n)
+	for _, s := range all[:n] {
+		owners = append(owners, s.node)
+	}
+	return owners
+}
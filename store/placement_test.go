@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOwners(t *testing.T) {
+	var nodes []cluster.Node
+	for i := 0; i < 10; i++ {
+		nodes = append(nodes, cluster.Node{Addr: fmt.Sprintf("node-%d", i)})
+	}
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		sum, _ := makeMemBlob(i)
+
+		owners := Owners(sum, nodes, 3)
+		assert.Len(t, owners, 3)
+
+		// the order in which nodes are known doesn't matter
+		reversed := make([]cluster.Node, len(nodes))
+		for j, nd := range nodes {
+			reversed[len(nodes)-1-j] = nd
+		}
+		assert.Equal(t, owners, Owners(sum, reversed, 3))
+
+		// only the sums owned by a leaving node are moved
+		without := Owners(sum, nodes[1:], 3)
+		if owners[0] != nodes[0] && owners[1] != nodes[0] && owners[2] != nodes[0] {
+			assert.Equal(t, owners, without)
+		} else {
+			moved++
+		}
+	}
+	// each node should own about 3/10th of the sums
+	assert.InDelta(t, 300, moved, 60)
+
+	sum, _ := makeMemBlob(0)
+	assert.Len(t, Owners(sum, nodes[:2], 3), 2, "can't have more owners than nodes")
+}
+
+func TestPlaced(t *testing.T) {
+	testStore(t, func() merkle.Store {
+		lc, _ := makeMemCluster(5)
+		cp := NewClusterPool(lc, lc.dial)
+		return Placed(cp, 2)
+	})
+}
+
+func TestPlacedGoesToOwners(t *testing.T) {
+	ctx := context.Background()
+	lc, stores := makeMemCluster(5)
+	cp := NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	placed := Placed(cp, 2)
+
+	for i := 0; i < 100; i++ {
+		sum, data := makeMemBlob(i)
+		if err := placed.PutBlob(ctx, sum, data); err != nil {
+			t.Fatal(err)
+		}
+		owners := Owners(sum, lc.Members(), 2)
+		for nd, st := range stores {
+			_, found, err := st.GetBlob(ctx, sum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			isOwner := nd == owners[0] || nd == owners[1]
+			assert.Equal(t, isOwner, found, "blob %d on %v", i, nd)
+		}
+	}
+}
+
+type memCluster struct {
+	fakeCluster
+	stores map[cluster.Node]merkle.Store
+}
+
+func makeMemCluster(n int) (*memCluster, map[cluster.Node]merkle.Store) {
+	lc := &memCluster{stores: make(map[cluster.Node]merkle.Store)}
+	for i := 0; i < n; i++ {
+		nd := cluster.Node{Addr: fmt.Sprintf("node-%d", i)}
+		lc.members = append(lc.members, nd)
+		lc.stores[nd] = NewMemoryStore()
+	}
+	lc.self = lc.members[0]
+	return lc, lc.stores
+}
+
+func (lc *memCluster) dial(nd cluster.Node) merkle.Store { return lc.stores[nd] }
@@ -1,6 +1,8 @@
 package store
 
 import (
+	"sync"
+
 	"github.com/aybabtme/epher/cluster"
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/log"
@@ -10,29 +12,128 @@ import (
 type Pool func() []merkle.Store
 
 // ClusterPool is a pool of remote merkle.Store which are
-// dynamically discovered and created with the dialer.
-func ClusterPool(lc cluster.Cluster, dial func(cluster.Node) merkle.Store) Pool {
-	return newStorePool(lc, func(nd cluster.Node) merkle.Store {
-		return SingleFlight(dial(nd))
-	})
+// dynamically discovered and created with the dialer. Each member of
+// the cluster is dialed once, when it joins, and its store is kept
+// until it leaves.
+type ClusterPool struct {
+	self cluster.Node
+	dial func(cluster.Node) merkle.Store
+	stop func()
+
+	mu      sync.RWMutex
+	members map[cluster.Node]member
+	peers   []merkle.Store // all the stores but our own
 }
 
-func newStorePool(
-	rc cluster.Cluster,
-	dial func(cluster.Node) merkle.Store,
-) Pool {
-	return func() []merkle.Store {
-		self := rc.Self()
-		nodes := rc.Members()
-		stores := make([]merkle.Store, 0, len(nodes))
-		for _, nd := range nodes {
-			if nd == self {
-				continue
-			}
-			stores = append(stores, dial(nd))
+type member struct {
+	store merkle.Store
+	peer  RepairPeer // nil if the dialed store can't repair
+}
+
+// NewClusterPool dials every member of the cluster and watches it
+// for members that join or leave.
+func NewClusterPool(lc cluster.Cluster, dial func(cluster.Node) merkle.Store) *ClusterPool {
+	cp := &ClusterPool{
+		self:    lc.Self(),
+		members: make(map[cluster.Node]member),
+		dial:    dial,
+	}
+	// watch before listing the members so that no change is missed.
+	// the changes wait until the members are known, and those that
+	// the list already has are applied again, which does nothing
+	cp.mu.Lock()
+	cp.stop = lc.Watch(cp.apply)
+	for _, nd := range lc.Members() {
+		cp.applyLocked(cluster.Event{Type: cluster.NodeJoin, Node: nd})
+	}
+	cp.mu.Unlock()
+	return cp
+}
+
+func (cp *ClusterPool) apply(ev cluster.Event) {
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.applyLocked(ev)
+}
+
+func (cp *ClusterPool) applyLocked(ev cluster.Event) {
+	switch ev.Type {
+	case cluster.NodeJoin:
+		if _, ok := cp.members[ev.Node]; ok {
+			return
+		}
+		cp.members[ev.Node] = cp.join(ev.Node)
+	case cluster.NodeLeave:
+		if _, ok := cp.members[ev.Node]; !ok {
+			return
+		}
+		delete(cp.members, ev.Node)
+	case cluster.NodeUpdate:
+		_, hasPrev := cp.members[ev.Prev]
+		if _, ok := cp.members[ev.Node]; ok && !hasPrev {
+			return
+		}
+		delete(cp.members, ev.Prev)
+		if _, ok := cp.members[ev.Node]; !ok {
+			cp.members[ev.Node] = cp.join(ev.Node)
+		}
+	}
+
+	peers := make([]merkle.Store, 0, len(cp.members))
+	for nd, m := range cp.members {
+		if nd == cp.self {
+			continue
 		}
-		log.KV("nodes", len(nodes)).
-			KV("count", len(stores)).Info("returning pool of nodes")
-		return stores
+		peers = append(peers, m.store)
+	}
+	cp.peers = peers
+
+	log.KV("event", ev.Type.String()).
+		KV("node", ev.Node.Addr).
+		KV("count", len(peers)).Info("cluster membership changed")
+}
+
+func (cp *ClusterPool) join(nd cluster.Node) member {
+	st := cp.dial(nd)
+	peer, _ := st.(RepairPeer)
+	return member{store: SingleFlight(st), peer: peer}
+}
+
+// Pool returns the stores of the other members of the cluster.
+func (cp *ClusterPool) Pool() Pool {
+	return func() []merkle.Store {
+		cp.mu.RLock()
+		defer cp.mu.RUnlock()
+		return cp.peers
 	}
 }
+
+// Store returns the store of a member of the cluster.
+func (cp *ClusterPool) Store(nd cluster.Node) (merkle.Store, bool) {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	m, ok := cp.members[nd]
+	return m.store, ok
+}
+
+// Peer returns the RepairPeer of a member of the cluster, which is the
+// store it was dialed with. It's nil if that store isn't a RepairPeer.
+func (cp *ClusterPool) Peer(nd cluster.Node) RepairPeer {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	return cp.members[nd].peer
+}
+
+// Nodes returns the members of the cluster known to the pool.
+func (cp *ClusterPool) Nodes() []cluster.Node {
+	cp.mu.RLock()
+	defer cp.mu.RUnlock()
+	nodes := make([]cluster.Node, 0, len(cp.members))
+	for nd := range cp.members {
+		nodes = append(nodes, nd)
+	}
+	return nodes
+}
+
+// Close stops watching the cluster.
+func (cp *ClusterPool) Close() { cp.stop() }
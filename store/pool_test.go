@@ -0,0 +1,121 @@
+package store
+
+import (
+	"testing"
+
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClusterPool(t *testing.T) {
+	var (
+		self  = cluster.Node{Addr: "self"}
+		nodeA = cluster.Node{Addr: "a"}
+		nodeB = cluster.Node{Addr: "b"}
+		nodeC = cluster.Node{Addr: "c"}
+	)
+	lc := &fakeCluster{self: self, members: []cluster.Node{self, nodeA, nodeB}}
+
+	dialed := make(map[cluster.Node]int)
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store {
+		dialed[nd]++
+		return NewMemoryStore()
+	})
+	defer cp.Close()
+
+	assert.Len(t, cp.Pool()(), 2, "should not include self")
+	assert.Len(t, cp.Nodes(), 3)
+
+	lc.Notify(cluster.Event{Type: cluster.NodeJoin, Node: nodeC})
+	lc.Notify(cluster.Event{Type: cluster.NodeLeave, Node: nodeA})
+	assert.Len(t, cp.Pool()(), 2)
+	_, ok := cp.Store(nodeA)
+	assert.False(t, ok, "a has left")
+	_, ok = cp.Store(nodeC)
+	assert.True(t, ok, "c has joined")
+
+	// repeated calls to the pool don't dial again
+	for i := 0; i < 10; i++ {
+		_ = cp.Pool()()
+	}
+	assert.Equal(t, map[cluster.Node]int{self: 1, nodeA: 1, nodeB: 1, nodeC: 1}, dialed)
+
+	assert.Nil(t, cp.Peer(nodeB), "memory stores aren't repair peers")
+
+	cp.Close()
+	lc.Notify(cluster.Event{Type: cluster.NodeLeave, Node: nodeB})
+	assert.Len(t, cp.Pool()(), 2, "closed pool should not be updated")
+}
+
+func TestClusterPoolPeer(t *testing.T) {
+	var (
+		self  = cluster.Node{Addr: "self"}
+		nodeA = cluster.Node{Addr: "a"}
+	)
+	lc := &fakeCluster{self: self, members: []cluster.Node{self, nodeA}}
+	peer := httpClient(t, nodeA.Addr, codec.Binary(), nil)
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store { return Forward(peer) })
+	defer cp.Close()
+
+	assert.NotNil(t, cp.Peer(nodeA), "forwarding keeps the peer")
+	assert.Nil(t, cp.Peer(cluster.Node{Addr: "b"}), "not a member")
+}
+
+func TestClusterPoolMissesNoChange(t *testing.T) {
+	var (
+		self  = cluster.Node{Addr: "self"}
+		nodeA = cluster.Node{Addr: "a"}
+		nodeB = cluster.Node{Addr: "b"}
+		nodeC = cluster.Node{Addr: "c"}
+	)
+	// a leaves while the pool lists the members
+	lc := &racyCluster{fakeCluster: fakeCluster{self: self, members: []cluster.Node{self, nodeA, nodeB}}}
+	lc.during = cluster.Event{Type: cluster.NodeLeave, Node: nodeA}
+
+	dialed := make(map[cluster.Node]int)
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store {
+		dialed[nd]++
+		return NewMemoryStore()
+	})
+	defer cp.Close()
+	<-lc.done
+
+	_, ok := cp.Store(nodeA)
+	assert.False(t, ok, "a has left")
+
+	// changes that were already applied do nothing
+	lc.Notify(cluster.Event{Type: cluster.NodeJoin, Node: nodeB})
+	lc.Notify(cluster.Event{Type: cluster.NodeUpdate, Node: nodeC, Prev: nodeB})
+	lc.Notify(cluster.Event{Type: cluster.NodeUpdate, Node: nodeC, Prev: nodeB})
+	lc.Notify(cluster.Event{Type: cluster.NodeLeave, Node: nodeB})
+	assert.Equal(t, map[cluster.Node]int{self: 1, nodeA: 1, nodeB: 1, nodeC: 1}, dialed)
+	assert.Len(t, cp.Nodes(), 2)
+}
+
+// racyCluster sends an event while its members are being listed.
+type racyCluster struct {
+	fakeCluster
+	during cluster.Event
+	done   chan struct{}
+}
+
+func (rc *racyCluster) Members() []cluster.Node {
+	rc.done = make(chan struct{})
+	go func() {
+		defer close(rc.done)
+		rc.Notify(rc.during)
+	}()
+	return rc.fakeCluster.Members()
+}
+
+type fakeCluster struct {
+	cluster.Watchers
+	self    cluster.Node
+	members []cluster.Node
+}
+
+func (fc *fakeCluster) Self() cluster.Node      { return fc.self }
+func (fc *fakeCluster) Members() []cluster.Node { return fc.members }
+func (fc *fakeCluster) Leave() error            { return nil }
@@ -0,0 +1,393 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/armon/go-metrics"
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/thash"
+	"github.com/aybabtme/log"
+)
+
+const digestBuckets = 256
+
+// Digest summarizes a set of entries. Entries are spread over
+// buckets by the first byte of their sum, and each bucket holds a
+// hash of its entries. Two sets holding the same entries have the
+// same digest, so only the buckets that differ need to be compared
+// entry by entry.
+type Digest [digestBuckets]uint64
+
+func bucketOf(sum thash.Sum) int {
+	if len(sum.Sum) == 0 {
+		return 0
+	}
+	return int(sum.Sum[0])
+}
+
+func (d *Digest) add(e Entry) {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte{byte(e.Kind), byte(e.Sum.Type), byte(e.Sum.Type >> 8)})
+	_, _ = h.Write([]byte(e.Sum.Sum))
+	// entries are only ever added once, so the order in which they
+	// are added doesn't matter
+	d[bucketOf(e.Sum)] ^= h.Sum64()
+}
+
+// A RepairPeer tells a Repairer what another member of the cluster
+// holds. It only considers the entries that it owns along with the
+// member asking, when each sum is owned by `replicas` members.
+type RepairPeer interface {
+	// Digest summarizes the entries held by the peer that it owns
+	// along with `with`.
+	Digest(ctx context.Context, with cluster.Node, replicas int) (Digest, error)
+	// Entries lists the entries in a bucket of the peer's digest.
+	Entries(ctx context.Context, with cluster.Node, replicas, bucket int) ([]Entry, error)
+}
+
+// ErrRepairsUnsupported is returned by a RepairPeer that doesn't serve
+// repairs. Repairers skip such peers.
+var ErrRepairsUnsupported = errors.New("peer doesn't serve repairs")
+
+// RepairStats counts what a Repairer did since it was created.
+type RepairStats struct {
+	// Rounds of repairs that ran.
+	Rounds int64
+	// Buckets found to differ between us and a peer.
+	Mismatches int64
+	// Blobs, and their total size, that were copied to an owner.
+	Blobs int64
+	Bytes int64
+	// Nodes that were copied to an owner.
+	Nodes int64
+	// Errors that interrupted a repair.
+	Errors int64
+}
+
+// Repairer restores the replication of the entries held by the local
+// store, by copying them to their owners that lost them.
+//
+// Every round, it compares the digest of the entries it owns along
+// with each of its peers with the digest of the same entries held by
+// that peer. The buckets that differ are listed, and the entries the
+// peer misses are copied over. Entries that the local store holds
+// without owning them, such as those written while their owners were
+// unreachable, are copied to all of their owners that lack them. The
+// local copy is kept, and is only handed off again once its owners
+// change.
+type Repairer struct {
+	pool     *ClusterPool
+	local    ListStore
+	replicas int
+	peer     func(cluster.Node) RepairPeer
+
+	mu        sync.Mutex // rounds don't overlap
+	handedOff map[Entry][]cluster.Node
+
+	// atomic
+	rounds     int64
+	mismatches int64
+	blobs      int64
+	bytes      int64
+	nodes      int64
+	errors     int64
+}
+
+// NewRepairer repairs the `replicas` copies of the entries held by
+// local. The peers are asked about what they hold through the
+// RepairPeer returned by peer, which may be nil for members that
+// can't be asked.
+func NewRepairer(cp *ClusterPool, local ListStore, replicas int, peer func(cluster.Node) RepairPeer) *Repairer {
+	return &Repairer{pool: cp, local: local, replicas: replicas, peer: peer}
+}
+
+// Stats tells what the repairer did so far.
+func (rp *Repairer) Stats() RepairStats {
+	return RepairStats{
+		Rounds:     atomic.LoadInt64(&rp.rounds),
+		Mismatches: atomic.LoadInt64(&rp.mismatches),
+		Blobs:      atomic.LoadInt64(&rp.blobs),
+		Bytes:      atomic.LoadInt64(&rp.bytes),
+		Nodes:      atomic.LoadInt64(&rp.nodes),
+		Errors:     atomic.LoadInt64(&rp.errors),
+	}
+}
+
+// Run repairs every interval, until ctx is done.
+func (rp *Repairer) Run(ctx context.Context, every time.Duration) {
+	tick := time.NewTicker(every)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		if err := rp.Repair(ctx); err != nil && ctx.Err() == nil {
+			log.Err(err).Error("can't repair")
+		}
+	}
+}
+
+// Repair runs a single round of repairs. Failing to repair a peer
+// doesn't stop the others from being repaired.
+func (rp *Repairer) Repair(ctx context.Context) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	defer metrics.MeasureSince([]string{"repair", "round"}, time.Now())
+	atomic.AddInt64(&rp.rounds, 1)
+	before := rp.Stats()
+
+	var (
+		self     = rp.pool.self
+		nodes    = rp.pool.Nodes()
+		digests  = make(map[cluster.Node]*Digest)
+		handoffs []Entry
+	)
+	err := rp.local.List(ctx, func(e Entry) error {
+		owners := Owners(e.Sum, nodes, rp.replicas)
+		if !hasNode(owners, self) {
+			handoffs = append(handoffs, e)
+			return nil
+		}
+		for _, nd := range owners {
+			if nd == self {
+				continue
+			}
+			d, ok := digests[nd]
+			if !ok {
+				d = new(Digest)
+				digests[nd] = d
+			}
+			d.add(e)
+		}
+		return nil
+	})
+	if err != nil {
+		rp.failed()
+		return err
+	}
+
+	for nd, d := range digests {
+		if err := rp.repairPeer(ctx, nodes, nd, d); err != nil {
+			rp.failed()
+			log.KV("peer", nd.Addr).Err(err).Error("can't repair peer")
+		}
+	}
+	handedOff := make(map[Entry][]cluster.Node, len(handoffs))
+	for _, e := range handoffs {
+		owners := Owners(e.Sum, nodes, rp.replicas)
+		if prev, ok := rp.handedOff[e]; ok && sameNodes(prev, owners) {
+			handedOff[e] = owners
+			continue
+		}
+		if err := rp.handoff(ctx, owners, e); err != nil {
+			rp.failed()
+			log.KV("kind", e.Kind.String()).Err(err).Error("can't hand off entry to its owners")
+			continue
+		}
+		handedOff[e] = owners
+	}
+	rp.handedOff = handedOff
+
+	after := rp.Stats()
+	if after.Blobs != before.Blobs || after.Nodes != before.Nodes {
+		log.KV("blobs", after.Blobs-before.Blobs).
+			KV("nodes", after.Nodes-before.Nodes).
+			KV("bytes", after.Bytes-before.Bytes).Info("repaired replicas")
+	}
+	return ctx.Err()
+}
+
+// repairPeer copies to nd the entries it owns along with us, and
+// which it doesn't have.
+func (rp *Repairer) repairPeer(ctx context.Context, nodes []cluster.Node, nd cluster.Node, local *Digest) error {
+	if rp.peer == nil {
+		return nil
+	}
+	peer := rp.peer(nd)
+	if peer == nil {
+		return nil
+	}
+	self := rp.pool.self
+
+	remote, err := peer.Digest(ctx, self, rp.replicas)
+	if err == ErrRepairsUnsupported {
+		log.KV("peer", nd.Addr).Info("peer doesn't serve repairs, skipping it")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	differ := make(map[int]bool)
+	for i := range local {
+		if local[i] != remote[i] {
+			differ[i] = true
+		}
+	}
+	if len(differ) == 0 {
+		return nil
+	}
+	atomic.AddInt64(&rp.mismatches, int64(len(differ)))
+	metrics.IncrCounter([]string{"repair", "mismatches"}, float32(len(differ)))
+
+	has := make(map[Entry]bool)
+	for bucket := range differ {
+		entries, err := peer.Entries(ctx, self, rp.replicas, bucket)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			has[e] = true
+		}
+	}
+
+	var missing []Entry
+	err = rp.local.List(ctx, func(e Entry) error {
+		if differ[bucketOf(e.Sum)] && !has[e] && rp.coOwned(e.Sum, nodes, self, nd, rp.replicas) {
+			missing = append(missing, e)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range missing {
+		if err := rp.copyTo(ctx, nd, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// handoff copies an entry that we don't own to its owners that don't
+// have it.
+func (rp *Repairer) handoff(ctx context.Context, owners []cluster.Node, e Entry) error {
+	for _, nd := range owners {
+		dst, ok := rp.pool.Store(nd)
+		if !ok {
+			continue
+		}
+		var (
+			found bool
+			err   error
+		)
+		switch e.Kind {
+		case BlobKind:
+			_, found, err = dst.InfoBlob(ctx, e.Sum)
+		case NodeKind:
+			_, found, err = dst.GetNode(ctx, e.Sum)
+		}
+		if err != nil {
+			return err
+		}
+		if found {
+			continue
+		}
+		if err := rp.copyTo(ctx, nd, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (rp *Repairer) copyTo(ctx context.Context, nd cluster.Node, e Entry) error {
+	dst, ok := rp.pool.Store(nd)
+	if !ok {
+		return fmt.Errorf("%q isn't a member of the cluster anymore", nd.Addr)
+	}
+	switch e.Kind {
+	case BlobKind:
+		data, found, err := rp.local.GetBlob(ctx, e.Sum)
+		if err != nil || !found {
+			return err
+		}
+		if err := dst.PutBlob(ctx, e.Sum, data); err != nil {
+			return err
+		}
+		atomic.AddInt64(&rp.blobs, 1)
+		atomic.AddInt64(&rp.bytes, int64(len(data)))
+		metrics.IncrCounter([]string{"repair", "blobs"}, 1)
+		metrics.IncrCounter([]string{"repair", "bytes"}, float32(len(data)))
+	case NodeKind:
+		node, found, err := rp.local.GetNode(ctx, e.Sum)
+		if err != nil || !found {
+			return err
+		}
+		if err := dst.PutNode(ctx, node); err != nil {
+			return err
+		}
+		atomic.AddInt64(&rp.nodes, 1)
+		metrics.IncrCounter([]string{"repair", "nodes"}, 1)
+	}
+	return nil
+}
+
+func (rp *Repairer) failed() {
+	atomic.AddInt64(&rp.errors, 1)
+	metrics.IncrCounter([]string{"repair", "errors"}, 1)
+}
+
+func (rp *Repairer) coOwned(sum thash.Sum, nodes []cluster.Node, a, b cluster.Node, replicas int) bool {
+	owners := Owners(sum, nodes, replicas)
+	return hasNode(owners, a) && hasNode(owners, b)
+}
+
+// Digest summarizes the local entries that we own along with `with`.
+func (rp *Repairer) Digest(ctx context.Context, with cluster.Node, replicas int) (Digest, error) {
+	var (
+		d     Digest
+		self  = rp.pool.self
+		nodes = rp.pool.Nodes()
+	)
+	err := rp.local.List(ctx, func(e Entry) error {
+		if rp.coOwned(e.Sum, nodes, self, with, replicas) {
+			d.add(e)
+		}
+		return nil
+	})
+	return d, err
+}
+
+// Entries lists the local entries in a bucket of our digest.
+func (rp *Repairer) Entries(ctx context.Context, with cluster.Node, replicas, bucket int) ([]Entry, error) {
+	var (
+		entries []Entry
+		self    = rp.pool.self
+		nodes   = rp.pool.Nodes()
+	)
+	err := rp.local.List(ctx, func(e Entry) error {
+		if bucketOf(e.Sum) == bucket && rp.coOwned(e.Sum, nodes, self, with, replicas) {
+			entries = append(entries, e)
+		}
+		return nil
+	})
+	return entries, err
+}
+
+func sameNodes(a, b []cluster.Node) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasNode(nodes []cluster.Node, nd cluster.Node) bool {
+	for _, other := range nodes {
+		if other == nd {
+			return true
+		}
+	}
+	return false
+}
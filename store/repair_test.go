@@ -0,0 +1,258 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepairerRestoresLostReplicas(t *testing.T) {
+	nodes, stores := makeListStores(5)
+	putReplicated(t, nodes, stores, 3)
+
+	// a member loses its disk
+	lost := countEntries(t, stores[nodes[2]])
+	stores[nodes[2]] = NewMemoryStore().(ListStore)
+
+	repairers := makeRepairers(nodes, stores, 3)
+	repairAll(t, nodes, repairers)
+	assertReplicated(t, nodes, stores, 3)
+
+	var repaired int64
+	for _, rp := range repairers {
+		stats := rp.Stats()
+		assert.Equal(t, int64(1), stats.Rounds)
+		assert.Zero(t, stats.Errors)
+		repaired += stats.Blobs + stats.Nodes
+	}
+	assert.Equal(t, int64(lost), repaired)
+
+	// once repaired, peers agree on what they hold
+	repairAll(t, nodes, repairers)
+	var again int64
+	for _, rp := range repairers {
+		stats := rp.Stats()
+		assert.Equal(t, int64(2), stats.Rounds)
+		assert.Zero(t, stats.Errors)
+		again += stats.Blobs + stats.Nodes
+	}
+	assert.Equal(t, repaired, again, "nothing more to repair")
+}
+
+func TestRepairerFollowsMembership(t *testing.T) {
+	nodes, stores := makeListStores(5)
+	putReplicated(t, nodes[:4], stores, 2)
+
+	// the first member leaves and a new one joins, some entries now
+	// belong to members that don't have them
+	members := nodes[1:]
+	repairers := makeRepairers(members, stores, 2)
+	repairAll(t, members, repairers)
+	assertReplicated(t, members, stores, 2)
+}
+
+func TestRepairerHandsOffOnce(t *testing.T) {
+	nodes, stores := makeListStores(4)
+	putReplicated(t, nodes[:3], stores, 1)
+
+	// a member joins, it now owns some of the entries of the others
+	var asked int
+	lc := &fakeCluster{self: nodes[0], members: nodes}
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store {
+		return &intercept{
+			around: func(ctx context.Context, method string, fn func(context.Context) error) error {
+				asked++
+				return fn(ctx)
+			},
+			wrap: stores[nd],
+		}
+	})
+	defer cp.Close()
+	rp := NewRepairer(cp, stores[nodes[0]], 1, nil)
+
+	if err := rp.Repair(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	handedOff := rp.Stats()
+	assert.NotZero(t, handedOff.Blobs+handedOff.Nodes)
+	before := asked
+	assert.NotZero(t, before)
+
+	// the owners already have what was handed to them
+	if err := rp.Repair(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, before, asked)
+	assert.Equal(t, handedOff.Blobs+handedOff.Nodes, rp.Stats().Blobs+rp.Stats().Nodes)
+}
+
+func TestRepairHTTP(t *testing.T) {
+	ctx := context.Background()
+	nodes, stores := makeListStores(3)
+	putReplicated(t, nodes, stores, 2)
+	repairers := makeRepairers(nodes, stores, 2)
+
+	cd := codec.Binary()
+	srv := httptest.NewServer(HTTPServer(cd, stores[nodes[1]], ServeRepairs(repairers[nodes[1]])))
+	defer srv.Close()
+	peer := httpClient(t, strings.TrimPrefix(srv.URL, "http://"), cd, &http.Client{}).(RepairPeer)
+
+	want, err := repairers[nodes[1]].Digest(ctx, nodes[0], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := peer.Digest(ctx, nodes[0], 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+	assert.NotEqual(t, Digest{}, got)
+
+	for bucket := 0; bucket < digestBuckets; bucket++ {
+		want, err := repairers[nodes[1]].Entries(ctx, nodes[0], 2, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := peer.Entries(ctx, nodes[0], 2, bucket)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sortEntries(want)
+		sortEntries(got)
+		assert.Equal(t, want, got, "bucket %d", bucket)
+	}
+}
+
+func TestRepairSkipsPeersWithoutRepairs(t *testing.T) {
+	ctx := context.Background()
+	nodes, stores := makeListStores(2)
+	putReplicated(t, nodes, stores, 2)
+	stores[nodes[1]] = NewMemoryStore().(ListStore)
+
+	cd := codec.Binary()
+	srv := httptest.NewServer(HTTPServer(cd, stores[nodes[1]]))
+	defer srv.Close()
+	peer := httpClient(t, strings.TrimPrefix(srv.URL, "http://"), cd, &http.Client{}).(RepairPeer)
+
+	_, err := peer.Digest(ctx, nodes[0], 2)
+	assert.Equal(t, ErrRepairsUnsupported, err)
+	_, err = peer.Entries(ctx, nodes[0], 2, 0)
+	assert.Equal(t, ErrRepairsUnsupported, err)
+
+	lc := &fakeCluster{self: nodes[0], members: nodes}
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store { return stores[nd] })
+	defer cp.Close()
+	rp := NewRepairer(cp, stores[nodes[0]], 2, func(cluster.Node) RepairPeer { return peer })
+	if err := rp.Repair(ctx); err != nil {
+		t.Fatal(err)
+	}
+	stats := rp.Stats()
+	assert.Zero(t, stats.Errors)
+	assert.Zero(t, stats.Blobs+stats.Nodes, "peers that don't serve repairs aren't repaired")
+}
+
+func sortEntries(entries []Entry) {
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Kind != entries[j].Kind {
+			return entries[i].Kind < entries[j].Kind
+		}
+		return entries[i].Sum.Sum < entries[j].Sum.Sum
+	})
+}
+
+func makeListStores(n int) ([]cluster.Node, map[cluster.Node]ListStore) {
+	var nodes []cluster.Node
+	stores := make(map[cluster.Node]ListStore)
+	for i := 0; i < n; i++ {
+		nd := cluster.Node{Addr: fmt.Sprintf("node-%d", i)}
+		nodes = append(nodes, nd)
+		stores[nd] = NewMemoryStore().(ListStore)
+	}
+	return nodes, stores
+}
+
+// putReplicated builds a few trees replicated on the members.
+func putReplicated(t *testing.T, members []cluster.Node, stores map[cluster.Node]ListStore, replicas int) {
+	lc := &fakeCluster{self: members[0], members: members}
+	cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store { return stores[nd] })
+	defer cp.Close()
+	rp := Replicated(cp, Quorum{N: replicas, W: replicas, R: 1})
+
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 10; i++ {
+		data := make([]byte, 1<<10)
+		_, _ = r.Read(data)
+		_, _, err := merkle.Build(context.Background(), bytes.NewReader(data), rp, merkle.WithBlobSize(64))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// makeRepairers gives each member its own view of the cluster and a
+// repairer, which talk to each other directly.
+func makeRepairers(members []cluster.Node, stores map[cluster.Node]ListStore, replicas int) map[cluster.Node]*Repairer {
+	repairers := make(map[cluster.Node]*Repairer)
+	peer := func(nd cluster.Node) RepairPeer { return repairers[nd] }
+	for _, nd := range members {
+		lc := &fakeCluster{self: nd, members: members}
+		cp := NewClusterPool(lc, func(nd cluster.Node) merkle.Store { return stores[nd] })
+		repairers[nd] = NewRepairer(cp, stores[nd], replicas, peer)
+	}
+	return repairers
+}
+
+func repairAll(t *testing.T, members []cluster.Node, repairers map[cluster.Node]*Repairer) {
+	for _, nd := range members {
+		if err := repairers[nd].Repair(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func countEntries(t *testing.T, store ListStore) int {
+	n := 0
+	err := store.List(context.Background(), func(Entry) error {
+		n++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+// assertReplicated checks that every entry held in the cluster is held
+// by all of its owners.
+func assertReplicated(t *testing.T, members []cluster.Node, stores map[cluster.Node]ListStore, replicas int) {
+	holders := make(map[Entry]map[cluster.Node]bool)
+	for nd, st := range stores {
+		err := st.List(context.Background(), func(e Entry) error {
+			if holders[e] == nil {
+				holders[e] = make(map[cluster.Node]bool)
+			}
+			holders[e][nd] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	assert.NotEmpty(t, holders)
+	for e, held := range holders {
+		for _, owner := range Owners(e.Sum, members, replicas) {
+			assert.True(t, held[owner], "%v %x should be on %v", e.Kind, e.Sum.Sum, owner)
+		}
+	}
+}
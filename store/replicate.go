@@ -0,0 +1,251 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// Quorum tells how many replicas of a sum are kept, and how many of
+// them must take part in reads and writes.
+type Quorum struct {
+	// N is the number of nodes that own each sum.
+	N int
+	// W is how many owners must acknowledge a write for it to succeed.
+	W int
+	// R is how many owners must answer a read for a sum to be
+	// reported missing.
+	R int
+}
+
+// Validate checks that the quorum can ever be met.
+func (q Quorum) Validate() error {
+	switch {
+	case q.N < 1:
+		return fmt.Errorf("quorum: need at least one replica, got N=%d", q.N)
+	case q.W < 1 || q.W > q.N:
+		return fmt.Errorf("quorum: W=%d must be between 1 and N=%d", q.W, q.N)
+	case q.R < 1 || q.R > q.N:
+		return fmt.Errorf("quorum: R=%d must be between 1 and N=%d", q.R, q.N)
+	}
+	return nil
+}
+
+// QuorumError is returned when not enough owners of a sum could take
+// part in an operation.
+type QuorumError struct {
+	Op   string
+	Sum  thash.Sum
+	Want int
+	Got  int
+	// Errs are the failures of the owners that didn't take part.
+	Errs []error
+}
+
+func (qe *QuorumError) Error() string {
+	msg := fmt.Sprintf("%s: quorum not met, %d of %d replicas required", qe.Op, qe.Got, qe.Want)
+	if len(qe.Errs) != 0 {
+		msg += fmt.Sprintf(", last error: %v", qe.Errs[len(qe.Errs)-1])
+	}
+	return msg
+}
+
+// Replicated keeps q.N replicas of every sum on the members of the
+// cluster that own it.
+//
+// Writes go to all the owners concurrently and succeed as soon as q.W
+// of them acknowledged. The other owners keep being written to in the
+// background, even once the caller moved on.
+//
+// Reads ask all the owners concurrently. Since sums address immutable
+// data, the first owner to find it answers the read. A sum is only
+// reported missing once q.R owners answered that they don't have it.
+func Replicated(cp *ClusterPool, q Quorum) merkle.Store {
+	return &replicated{pool: cp, q: q}
+}
+
+// Placed sends everything to the `replicas` members of the cluster
+// that own it. Writes must reach all the owners, reads succeed as soon
+// as any one of them answers.
+func Placed(cp *ClusterPool, replicas int) merkle.Store {
+	return Replicated(cp, Quorum{N: replicas, W: replicas, R: 1})
+}
+
+type replicated struct {
+	pool *ClusterPool
+	q    Quorum
+}
+
+func (rp *replicated) owners(sum thash.Sum) []merkle.Store {
+	nodes := Owners(sum, rp.pool.Nodes(), rp.q.N)
+	stores := make([]merkle.Store, 0, len(nodes))
+	for _, nd := range nodes {
+		if st, ok := rp.pool.Store(nd); ok {
+			stores = append(stores, st)
+		}
+	}
+	return stores
+}
+
+// writeTimeout bounds the writes to each owner, including those that
+// go on after the quorum was met.
+var writeTimeout = time.Minute
+
+// detached keeps the values of a context, but is never cancelled and
+// has no deadline.
+type detached struct{ parent context.Context }
+
+func (detached) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detached) Done() <-chan struct{}               { return nil }
+func (detached) Err() error                          { return nil }
+func (d detached) Value(key interface{}) interface{} { return d.parent.Value(key) }
+
+// write calls fn on all the owners of sum, and succeeds once W of
+// them did.
+func (rp *replicated) write(
+	ctx context.Context,
+	op string,
+	sum thash.Sum,
+	fn func(context.Context, merkle.Store) error,
+) error {
+	owners := rp.owners(sum)
+	if len(owners) < rp.q.W {
+		return &QuorumError{Op: op, Sum: sum, Want: rp.q.W, Got: len(owners), Errs: []error{errNoOwner}}
+	}
+
+	// the writes that didn't make the quorum outlive the call, so
+	// they must not be cancelled along with it, but an owner that
+	// hangs mustn't keep them around forever either
+	ctx, cancel := context.WithTimeout(detached{ctx}, writeTimeout)
+	var wg sync.WaitGroup
+	wg.Add(len(owners))
+	errc := make(chan error, len(owners))
+	for _, st := range owners {
+		go func(st merkle.Store) {
+			defer wg.Done()
+			errc <- fn(ctx, st)
+		}(st)
+	}
+	go func() { wg.Wait(); cancel() }()
+
+	var (
+		acks int
+		errs []error
+	)
+	for range owners {
+		err := <-errc
+		if err != nil {
+			errs = append(errs, err)
+			if len(owners)-len(errs) < rp.q.W {
+				break
+			}
+			continue
+		}
+		acks++
+		if acks == rp.q.W {
+			return nil
+		}
+	}
+	return &QuorumError{Op: op, Sum: sum, Want: rp.q.W, Got: acks, Errs: errs}
+}
+
+// read calls fn on all the owners of sum, and returns the first
+// answer that found something.
+func (rp *replicated) read(
+	ctx context.Context,
+	op string,
+	sum thash.Sum,
+	fn func(context.Context, merkle.Store) (answer interface{}, found bool, err error),
+) (interface{}, bool, error) {
+	owners := rp.owners(sum)
+	if len(owners) < rp.q.R {
+		return nil, false, &QuorumError{Op: op, Sum: sum, Want: rp.q.R, Got: len(owners), Errs: []error{errNoOwner}}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		answer interface{}
+		found  bool
+		err    error
+	}
+	resc := make(chan result, len(owners))
+	for _, st := range owners {
+		go func(st merkle.Store) {
+			answer, found, err := fn(ctx, st)
+			resc <- result{answer: answer, found: found, err: err}
+		}(st)
+	}
+
+	var (
+		missing int
+		errs    []error
+	)
+	for range owners {
+		res := <-resc
+		switch {
+		case res.err != nil:
+			errs = append(errs, res.err)
+		case res.found:
+			return res.answer, true, nil
+		default:
+			missing++
+		}
+	}
+	if missing < rp.q.R {
+		return nil, false, &QuorumError{Op: op, Sum: sum, Want: rp.q.R, Got: missing, Errs: errs}
+	}
+	return nil, false, nil
+}
+
+func (rp *replicated) PutNode(ctx context.Context, node merkle.Node) error {
+	return rp.write(ctx, "PutNode", node.Sum, func(ctx context.Context, store merkle.Store) error {
+		return store.PutNode(ctx, node)
+	})
+}
+
+func (rp *replicated) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
+	answer, found, err := rp.read(ctx, "GetNode", sum, func(ctx context.Context, store merkle.Store) (interface{}, bool, error) {
+		return store.GetNode(ctx, sum)
+	})
+	if !found {
+		return merkle.Node{}, false, err
+	}
+	return answer.(merkle.Node), true, nil
+}
+
+func (rp *replicated) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	if rp.q.W < rp.q.N {
+		// callers can reuse data once we return, while some owners
+		// are still being written to
+		data = append([]byte(nil), data...)
+	}
+	return rp.write(ctx, "PutBlob", sum, func(ctx context.Context, store merkle.Store) error {
+		return store.PutBlob(ctx, sum, data)
+	})
+}
+
+func (rp *replicated) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	answer, found, err := rp.read(ctx, "GetBlob", sum, func(ctx context.Context, store merkle.Store) (interface{}, bool, error) {
+		return store.GetBlob(ctx, sum)
+	})
+	if !found {
+		return nil, false, err
+	}
+	return answer.([]byte), true, nil
+}
+
+func (rp *replicated) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
+	answer, found, err := rp.read(ctx, "InfoBlob", sum, func(ctx context.Context, store merkle.Store) (interface{}, bool, error) {
+		return store.InfoBlob(ctx, sum)
+	})
+	if !found {
+		return merkle.BlobInfo{}, false, err
+	}
+	return answer.(merkle.BlobInfo), true, nil
+}
@@ -0,0 +1,196 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/epher/cluster"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReplicated(t *testing.T) {
+	testStore(t, func() merkle.Store {
+		lc, _ := makeMemCluster(5)
+		cp := NewClusterPool(lc, lc.dial)
+		return Replicated(cp, Quorum{N: 3, W: 2, R: 2})
+	})
+}
+
+func TestQuorumValidate(t *testing.T) {
+	tests := []struct {
+		q     Quorum
+		valid bool
+	}{
+		{Quorum{N: 1, W: 1, R: 1}, true},
+		{Quorum{N: 3, W: 2, R: 2}, true},
+		{Quorum{N: 3, W: 3, R: 1}, true},
+		{Quorum{N: 0, W: 0, R: 0}, false},
+		{Quorum{N: 3, W: 0, R: 1}, false},
+		{Quorum{N: 3, W: 4, R: 1}, false},
+		{Quorum{N: 3, W: 1, R: 4}, false},
+	}
+	for _, tt := range tests {
+		err := tt.q.Validate()
+		assert.Equal(t, tt.valid, err == nil, "%+v: %v", tt.q, err)
+	}
+}
+
+func TestReplicatedWriteQuorum(t *testing.T) {
+	ctx := context.Background()
+	lc, _ := makeMemCluster(5)
+	broken := lc.breakNodes(lc.members[3:]...)
+	cp := NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	rp := Replicated(cp, Quorum{N: 3, W: 2, R: 1})
+
+	var failed, succeeded int
+	for i := 0; i < 100; i++ {
+		sum, data := makeMemBlob(i)
+		err := rp.PutBlob(ctx, sum, data)
+
+		healthy := 0
+		for _, nd := range Owners(sum, lc.Members(), 3) {
+			if !broken[nd] {
+				healthy++
+			}
+		}
+		if healthy >= 2 {
+			assert.NoError(t, err, "blob %d", i)
+			succeeded++
+			continue
+		}
+		failed++
+		var qe *QuorumError
+		if assert.True(t, errors.As(err, &qe), "blob %d: %v", i, err) {
+			assert.Equal(t, "PutBlob", qe.Op)
+			assert.Equal(t, 2, qe.Want)
+			// the write gives up as soon as two of the three owners
+			// failed, since the quorum can't be met anymore
+			assert.True(t, qe.Got <= healthy)
+			assert.Len(t, qe.Errs, 2)
+		}
+	}
+	assert.NotZero(t, failed)
+	assert.NotZero(t, succeeded)
+}
+
+func TestReplicatedWritesAllReplicas(t *testing.T) {
+	ctx := context.Background()
+	lc, stores := makeMemCluster(5)
+	cp := NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	rp := Replicated(cp, Quorum{N: 3, W: 3, R: 1})
+
+	for i := 0; i < 100; i++ {
+		sum, data := makeMemBlob(i)
+		if err := rp.PutBlob(ctx, sum, data); err != nil {
+			t.Fatal(err)
+		}
+		copies := 0
+		for _, st := range stores {
+			_, found, err := st.GetBlob(ctx, sum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found {
+				copies++
+			}
+		}
+		assert.Equal(t, 3, copies, "blob %d", i)
+	}
+}
+
+func TestReplicatedReadQuorum(t *testing.T) {
+	ctx := context.Background()
+	sum, data := makeMemBlob(0)
+
+	lc, stores := makeMemCluster(5)
+	owners := Owners(sum, lc.Members(), 3)
+
+	// a single owner is enough to find the blob
+	if err := stores[owners[2]].PutBlob(ctx, sum, data); err != nil {
+		t.Fatal(err)
+	}
+	lc.breakNodes(owners[0], owners[1])
+	cp := NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	got, found, err := Replicated(cp, Quorum{N: 3, W: 2, R: 2}).GetBlob(ctx, sum)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, data, got)
+
+	// a sum is missing once R owners don't have it
+	lc, _ = makeMemCluster(5)
+	lc.breakNodes(owners[0])
+	cp = NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	_, found, err = Replicated(cp, Quorum{N: 3, W: 2, R: 2}).GetBlob(ctx, sum)
+	assert.NoError(t, err)
+	assert.False(t, found)
+
+	// but it's an error if not enough owners answered
+	lc, _ = makeMemCluster(5)
+	lc.breakNodes(owners[0], owners[1])
+	cp = NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+	_, found, err = Replicated(cp, Quorum{N: 3, W: 2, R: 2}).GetBlob(ctx, sum)
+	assert.False(t, found)
+	var qe *QuorumError
+	if assert.True(t, errors.As(err, &qe), "%v", err) {
+		assert.Equal(t, "GetBlob", qe.Op)
+		assert.Equal(t, 1, qe.Got)
+		assert.Len(t, qe.Errs, 2)
+	}
+}
+
+var errBroken = errors.New("broken store")
+
+// breakNodes makes the stores of nodes fail every request.
+func (lc *memCluster) breakNodes(nodes ...cluster.Node) map[cluster.Node]bool {
+	broken := make(map[cluster.Node]bool)
+	for _, nd := range nodes {
+		lc.stores[nd] = &intercept{
+			around: func(context.Context, string, func(context.Context) error) error {
+				return errBroken
+			},
+			wrap: lc.stores[nd],
+		}
+		broken[nd] = true
+	}
+	return broken
+}
+
+func TestReplicatedWritesTimeOut(t *testing.T) {
+	defer func(timeout time.Duration) { writeTimeout = timeout }(writeTimeout)
+	writeTimeout = 50 * time.Millisecond
+
+	ctx := context.Background()
+	sum, data := makeMemBlob(0)
+	lc, _ := makeMemCluster(5)
+	owners := Owners(sum, lc.Members(), 3)
+
+	// an owner that hangs until its write is given up on
+	hung := make(chan error, 1)
+	lc.stores[owners[0]] = &intercept{
+		around: func(ctx context.Context, _ string, _ func(context.Context) error) error {
+			<-ctx.Done()
+			hung <- ctx.Err()
+			return ctx.Err()
+		},
+		wrap: lc.stores[owners[0]],
+	}
+	cp := NewClusterPool(lc, lc.dial)
+	defer cp.Close()
+
+	err := Replicated(cp, Quorum{N: 3, W: 2, R: 1}).PutBlob(ctx, sum, data)
+	assert.NoError(t, err)
+	select {
+	case err := <-hung:
+		assert.Equal(t, context.DeadlineExceeded, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the write to the hung owner was never given up on")
+	}
+}
@@ -1,15 +1,21 @@
 package store
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 
 	"net/url"
 
+	"github.com/aybabtme/epher/cluster"
 	"github.com/aybabtme/epher/codec"
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/epher/thash"
@@ -24,36 +30,73 @@ type rpcClient struct {
 	baseURL *url.URL
 	codec   codec.Codec
 	cl      *http.Client
+	token   string
 }
 
-func HTTPClient(addr string, codec codec.Codec, cl *http.Client) merkle.Store {
+// HTTPClient talks to the merkle.Store served by HTTPServer at addr,
+// in codec. Answers are decoded in the codec they come in, and are
+// taken to be binary when they don't say, as older servers only spoke
+// binary. The store it returns is also a RepairPeer.
+func HTTPClient(addr string, codec codec.Codec, cl *http.Client, opts ...ClientOption) (merkle.StreamStore, error) {
+	var config clientConfig
+	for _, o := range opts {
+		o(&config)
+	}
 	if cl == nil {
 		cl = new(http.Client)
 	}
-	cl.Transport = &nethttp.Transport{cl.Transport}
-
 	u := &url.URL{
-		Scheme: "http", // don't use clear text =/
+		Scheme: "http",
 		Host:   addr,
 	}
+	if config.tls != nil {
+		tr, err := withTLS(cl.Transport, config.tls)
+		if err != nil {
+			return nil, err
+		}
+		u.Scheme = "https"
+		cl.Transport = tr
+	}
+	cl.Transport = &nethttp.Transport{RoundTripper: cl.Transport}
+
+	return &rpcClient{baseURL: u, codec: codec, cl: cl, token: config.token}, nil
+}
+
+// ClientOption configures an HTTPClient.
+type ClientOption func(*clientConfig)
+
+type clientConfig struct {
+	tls   *tls.Config
+	token string
+}
 
-	return &rpcClient{baseURL: u, codec: codec, cl: cl}
+// ClientToken authenticates with a bearer token, for servers that
+// Authenticate their clients.
+func ClientToken(token string) ClientOption {
+	return func(cc *clientConfig) { cc.token = token }
+}
+
+// ClientTLS talks to the server over TLS. The transport of the
+// http.Client, if any, must be an *http.Transport, or HTTPClient fails.
+func ClientTLS(config *tls.Config) ClientOption {
+	return func(cc *clientConfig) { cc.tls = config }
 }
 
 func (rpc *rpcClient) do(
 	ctx context.Context,
 	method, pathStr string,
 	onReq func(io.Writer) error,
-	onResp func(r io.Reader) error,
+	onResp func(cd codec.Codec, r io.Reader) error,
 ) error {
 
 	var body io.Reader
 	if onReq != nil {
-		buf := bytes.NewBuffer(nil)
-		if err := onReq(buf); err != nil {
-			return err
-		}
-		body = buf
+		// stream the request body as it's encoded, rather than
+		// buffering it whole
+		pr, pw := io.Pipe()
+		defer pr.Close()
+		go func() { _ = pw.CloseWithError(onReq(pw)) }()
+		body = pr
 	}
 	u, err := rpc.baseURL.Parse(pathStr)
 	if err != nil {
@@ -65,6 +108,16 @@ func (rpc *rpcClient) do(
 		return err
 	}
 	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", rpc.codec.ContentType())
+	}
+	req.Header.Set("Accept", rpc.codec.ContentType())
+	if rpc.token != "" {
+		req.Header.Set("Authorization", "Bearer "+rpc.token)
+	}
+	if IsForwarded(ctx) {
+		req.Header.Set(forwardedHeader, "true")
+	}
 
 	tracer := opentracing.GlobalTracer()
 	req, ht := nethttp.TraceRequest(tracer, req)
@@ -77,16 +130,23 @@ func (rpc *rpcClient) do(
 		return err
 	}
 	defer resp.Body.Close()
-	if onResp == nil {
-		return nil
-	}
 	if resp.StatusCode == http.StatusNotFound {
-		return nil
+		return errNotFound
+	}
+	if resp.StatusCode == http.StatusUnprocessableEntity {
+		return errUnprocessable
 	}
 	if resp.StatusCode != http.StatusOK {
 		return fmt.Errorf("unexpected status %q", resp.Status)
 	}
-	err = onResp(resp.Body)
+	if onResp == nil {
+		return nil
+	}
+	cd, ok := codec.Negotiate(rpc.codec, resp.Header.Get("Content-Type"))
+	if !ok {
+		cd, _ = codec.Negotiate(rpc.codec, codec.Binary().ContentType())
+	}
+	err = onResp(cd, resp.Body)
 	if err != nil {
 		ext.Error.Set(ht.Span(), true)
 		ht.Span().LogKV("err", err)
@@ -94,108 +154,261 @@ func (rpc *rpcClient) do(
 	return err
 }
 
+var (
+	// errNotFound is returned by do when the server doesn't have
+	// what was asked, or doesn't serve the route at all.
+	errNotFound = errors.New("not found")
+	// errUnprocessable is returned by do when the server refuses
+	// what it was sent, because it doesn't match its sum.
+	errUnprocessable = errors.New("unprocessable entity")
+)
+
 func (rpc *rpcClient) PutNode(ctx context.Context, node merkle.Node) error {
-	return rpc.do(ctx, "PUT", "/v1/nodes",
+	err := rpc.do(ctx, "PUT", "/v1/nodes",
 		func(w io.Writer) error {
 			return rpc.codec.EncodeNode(w, node)
 		},
 		nil,
 	)
+	if err == errUnprocessable {
+		return &MismatchError{Sum: node.Sum}
+	}
+	return err
 }
 func (rpc *rpcClient) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
 	var (
 		node  merkle.Node
 		found bool
 	)
-	return node, found, rpc.do(ctx, "GET", "/v1/nodes",
+	err := rpc.do(ctx, "GET", "/v1/nodes",
 		func(w io.Writer) error {
 			return rpc.codec.EncodeSum(w, sum)
 		},
-		func(resp io.Reader) error {
-			err := rpc.codec.DecodeNode(resp, &node)
+		func(cd codec.Codec, resp io.Reader) error {
+			err := cd.DecodeNode(resp, &node)
 			found = true
 			return err
 		},
 	)
+	if err == errNotFound {
+		return node, false, nil
+	}
+	return node, found, err
 }
 func (rpc *rpcClient) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
-	return rpc.do(ctx, "PUT", "/v1/blobs",
+	return rpc.PutBlobStream(ctx, sum, int64(len(data)), bytes.NewReader(data))
+}
+func (rpc *rpcClient) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	buf := bytes.NewBuffer(nil)
+	found, err := rpc.GetBlobStream(ctx, sum, buf)
+	return buf.Bytes(), found, err
+}
+func (rpc *rpcClient) PutBlobStream(ctx context.Context, sum thash.Sum, size int64, r io.Reader) error {
+	err := rpc.do(ctx, "PUT", "/v1/blobs",
 		func(w io.Writer) error {
-			return rpc.codec.EncodeBlob(w, sum, data)
+			return rpc.codec.EncodeBlobStream(w, sum, size, r)
 		},
 		nil,
 	)
+	if err == errUnprocessable {
+		return &MismatchError{Sum: sum}
+	}
+	return err
 }
-func (rpc *rpcClient) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
-	var (
-		buf   = bytes.NewBuffer(nil)
-		found bool
-	)
+func (rpc *rpcClient) GetBlobStream(ctx context.Context, sum thash.Sum, w io.Writer) (bool, error) {
+	var found bool
 	err := rpc.do(ctx, "GET", "/v1/blobs",
 		func(w io.Writer) error {
 			return rpc.codec.EncodeSum(w, sum)
 		},
-		func(resp io.Reader) error {
-			err := rpc.codec.DecodeBlob(resp, new(thash.Sum), buf)
+		func(cd codec.Codec, resp io.Reader) error {
+			size, blob, err := cd.DecodeBlobStream(resp, new(thash.Sum))
+			if err != nil {
+				return err
+			}
 			found = true
-			return err
+			return merkle.CopyBlob(w, blob, size)
 		},
 	)
-	return buf.Bytes(), found, err
+	if err == errNotFound {
+		return false, nil
+	}
+	return found, err
 }
 func (rpc *rpcClient) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
 	var (
 		info  merkle.BlobInfo
 		found bool
 	)
-	return info, found, rpc.do(ctx, "HEAD", "/v1/blobs",
+	err := rpc.do(ctx, "GET", "/v1/blobs/info",
 		func(w io.Writer) error {
 			return rpc.codec.EncodeSum(w, sum)
 		},
-		func(resp io.Reader) error {
-			err := rpc.codec.DecodeBlobInfo(resp, &info)
+		func(cd codec.Codec, resp io.Reader) error {
+			err := cd.DecodeBlobInfo(resp, &info)
 			found = true
 			return err
 		},
 	)
+	if err == errNotFound {
+		return info, false, nil
+	}
+	return info, found, err
+}
+
+func (rpc *rpcClient) Digest(ctx context.Context, with cluster.Node, replicas int) (Digest, error) {
+	var d Digest
+	q := url.Values{
+		"with":     {with.Addr},
+		"replicas": {strconv.Itoa(replicas)},
+	}
+	err := rpc.do(ctx, "GET", "/v1/repair/digest?"+q.Encode(), nil,
+		func(_ codec.Codec, resp io.Reader) error {
+			return binary.Read(resp, binary.LittleEndian, &d)
+		},
+	)
+	if err == errNotFound {
+		return d, ErrRepairsUnsupported
+	}
+	return d, err
+}
+func (rpc *rpcClient) Entries(ctx context.Context, with cluster.Node, replicas, bucket int) ([]Entry, error) {
+	var entries []Entry
+	q := url.Values{
+		"with":     {with.Addr},
+		"replicas": {strconv.Itoa(replicas)},
+		"bucket":   {strconv.Itoa(bucket)},
+	}
+	err := rpc.do(ctx, "GET", "/v1/repair/entries?"+q.Encode(), nil,
+		func(_ codec.Codec, resp io.Reader) error {
+			// repairs are between nodes, which speak binary
+			cd := codec.Binary()
+			for {
+				var kind [1]byte
+				if _, err := io.ReadFull(resp, kind[:]); err == io.EOF {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				e := Entry{Kind: Kind(kind[0])}
+				if err := cd.DecodeSum(resp, &e.Sum); err != nil {
+					return err
+				}
+				entries = append(entries, e)
+			}
+		},
+	)
+	if err == errNotFound {
+		return nil, ErrRepairsUnsupported
+	}
+	return entries, err
 }
 
 type rpcServer struct {
-	codec codec.Codec
-	store merkle.Store
-	log   *log.Log
+	codec  codec.Codec
+	store  merkle.StreamStore
+	repair RepairPeer
+	tokens TokenStore
+	log    *log.Log
 }
 
-func HTTPServer(codec codec.Codec, store merkle.Store) http.Handler {
+// ServerOption configures an HTTPServer.
+type ServerOption func(*rpcServer)
+
+// Authenticate only serves requests that bear a token with the scope
+// they need: reads need ReadScope and writes need WriteScope. Requests
+// forwarded by peers and repairs also need PeerScope.
+func Authenticate(tokens TokenStore) ServerOption {
+	return func(rpc *rpcServer) { rpc.tokens = tokens }
+}
 
-	rpc := &rpcServer{codec: codec, store: store, log: log.KV("rpc", "server")}
+// ServeRepairs answers the peers of a Repairer with peer.
+func ServeRepairs(peer RepairPeer) ServerOption {
+	return func(rpc *rpcServer) { rpc.repair = peer }
+}
+
+func HTTPServer(codec codec.Codec, store merkle.Store, opts ...ServerOption) http.Handler {
+
+	rpc := &rpcServer{codec: codec, store: merkle.Streaming(store), log: log.KV("rpc", "server")}
+	for _, o := range opts {
+		o(rpc)
+	}
 	router := httprouter.New()
 	router.PUT("/v1/nodes", rpc.PutNode)
 	router.GET("/v1/nodes", rpc.GetNode)
 	router.PUT("/v1/blobs", rpc.PutBlob)
 	router.GET("/v1/blobs", rpc.GetBlob)
-	router.HEAD("/v1/blobs", rpc.InfoBlob)
+	router.GET("/v1/blobs/info", rpc.InfoBlob)
+	router.GET("/v1/objects/:sum", rpc.GetObject)
+	router.HEAD("/v1/objects/:sum", rpc.GetObject)
+	if rpc.repair != nil {
+		router.GET("/v1/repair/digest", rpc.Digest)
+		router.GET("/v1/repair/entries", rpc.Entries)
+	}
+
+	maxBody := maxRequestSize(rpc.codec)
+	var handler http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		if r.Header.Get(forwardedHeader) != "" {
+			r = r.WithContext(withForwarded(r.Context()))
+		}
+		router.ServeHTTP(w, r)
+	})
+	if rpc.tokens != nil {
+		handler = authenticate(rpc.tokens, handler)
+	}
 
 	return nethttp.Middleware(
 		opentracing.GlobalTracer(),
-		router,
+		handler,
 		nethttp.OperationNameFunc(func(r *http.Request) string {
 			switch {
 			case strings.HasPrefix(r.URL.Path, "/v1/nodes"):
 				return "rpcServer." + r.Method + "." + "Nodes"
 			case strings.HasPrefix(r.URL.Path, "/v1/blobs"):
 				return "rpcServer." + r.Method + "." + "Blobs"
+			case strings.HasPrefix(r.URL.Path, "/v1/objects"):
+				return "rpcServer." + r.Method + "." + "Objects"
+			case strings.HasPrefix(r.URL.Path, "/v1/repair"):
+				return "rpcServer." + r.Method + "." + "Repair"
 			}
 			return "HTTP" + r.Method
 		}),
 	)
 }
 
+// codecs picks the codec the body of a request is in, from its
+// Content-Type, and the one to answer in, from its Accept header.
+// Requests that don't say are in the server's codec, and are answered
+// in the codec they came in.
+func (rpc *rpcServer) codecs(w http.ResponseWriter, r *http.Request) (in, out codec.Codec, ok bool) {
+	in = rpc.codec
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if in, ok = codec.Negotiate(rpc.codec, ct); !ok {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			fmt.Fprintf(w, "unsupported content type %q", ct)
+			return nil, nil, false
+		}
+	}
+	out = in
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if cd, ok := codec.Negotiate(rpc.codec, strings.TrimSpace(accept)); ok {
+			out = cd
+			break
+		}
+	}
+	return in, out, true
+}
+
 func (rpc *rpcServer) PutNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	in, _, ok := rpc.codecs(w, r)
+	if !ok {
+		return
+	}
 
 	var node merkle.Node
-	err := rpc.codec.DecodeNode(r.Body, &node)
+	err := in.DecodeNode(r.Body, &node)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
@@ -204,17 +417,36 @@ func (rpc *rpcServer) PutNode(w http.ResponseWriter, r *http.Request, _ httprout
 
 	err = rpc.store.PutNode(ctx, node)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(putStatus(err))
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 }
 
+// maxRequestSize bounds the body of requests, which hold at most the
+// largest blob cd decodes, in base64 with JSON, and a few sums.
+func maxRequestSize(cd codec.Codec) int64 {
+	return (codec.MaxBlobSize(cd)+2)/3*4 + 64<<10
+}
+
+// putStatus is the status of a put that failed with err.
+func putStatus(err error) int {
+	var mismatch *MismatchError
+	if errors.As(err, &mismatch) {
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusInternalServerError
+}
+
 func (rpc *rpcServer) GetNode(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	in, out, ok := rpc.codecs(w, r)
+	if !ok {
+		return
+	}
 
 	var sum thash.Sum
-	err := rpc.codec.DecodeSum(r.Body, &sum)
+	err := in.DecodeSum(r.Body, &sum)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
@@ -231,7 +463,8 @@ func (rpc *rpcServer) GetNode(w http.ResponseWriter, r *http.Request, _ httprout
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := rpc.codec.EncodeNode(w, node); err != nil {
+	w.Header().Set("Content-Type", out.ContentType())
+	if err := out.EncodeNode(w, node); err != nil {
 		rpc.log.Err(err).Info("can't send node to client")
 		return
 	}
@@ -239,21 +472,22 @@ func (rpc *rpcServer) GetNode(w http.ResponseWriter, r *http.Request, _ httprout
 
 func (rpc *rpcServer) PutBlob(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	in, _, ok := rpc.codecs(w, r)
+	if !ok {
+		return
+	}
 
-	var (
-		sum thash.Sum
-		buf = bytes.NewBuffer(nil)
-	)
-	err := rpc.codec.DecodeBlob(r.Body, &sum, buf)
+	var sum thash.Sum
+	size, blob, err := in.DecodeBlobStream(r.Body, &sum)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 
-	err = rpc.store.PutBlob(ctx, sum, buf.Bytes())
+	err = rpc.store.PutBlobStream(ctx, sum, size, blob)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(putStatus(err))
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
@@ -261,16 +495,21 @@ func (rpc *rpcServer) PutBlob(w http.ResponseWriter, r *http.Request, _ httprout
 
 func (rpc *rpcServer) GetBlob(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	in, out, ok := rpc.codecs(w, r)
+	if !ok {
+		return
+	}
 
 	var sum thash.Sum
-	err := rpc.codec.DecodeSum(r.Body, &sum)
+	err := in.DecodeSum(r.Body, &sum)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
 		return
 	}
 
-	blob, found, err := rpc.store.GetBlob(ctx, sum)
+	// the size of the blob must be known before it can be streamed
+	info, found, err := rpc.store.InfoBlob(ctx, sum)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
@@ -280,7 +519,18 @@ func (rpc *rpcServer) GetBlob(w http.ResponseWriter, r *http.Request, _ httprout
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := rpc.codec.EncodeBlob(w, sum, blob); err != nil {
+
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		found, err := rpc.store.GetBlobStream(ctx, sum, pw)
+		if err == nil && !found {
+			err = io.ErrUnexpectedEOF
+		}
+		_ = pw.CloseWithError(err)
+	}()
+	w.Header().Set("Content-Type", out.ContentType())
+	if err := out.EncodeBlobStream(w, sum, info.Size, pr); err != nil {
 		rpc.log.Err(err).Info("can't send blob to client")
 		return
 	}
@@ -288,9 +538,13 @@ func (rpc *rpcServer) GetBlob(w http.ResponseWriter, r *http.Request, _ httprout
 
 func (rpc *rpcServer) InfoBlob(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
 	ctx := r.Context()
+	in, out, ok := rpc.codecs(w, r)
+	if !ok {
+		return
+	}
 
 	var sum thash.Sum
-	err := rpc.codec.DecodeSum(r.Body, &sum)
+	err := in.DecodeSum(r.Body, &sum)
 	if err != nil {
 		w.WriteHeader(http.StatusBadRequest)
 		fmt.Fprintf(w, "%v", err)
@@ -307,8 +561,88 @@ func (rpc *rpcServer) InfoBlob(w http.ResponseWriter, r *http.Request, _ httprou
 		w.WriteHeader(http.StatusNotFound)
 		return
 	}
-	if err := rpc.codec.EncodeBlobInfo(w, info); err != nil {
+	w.Header().Set("Content-Type", out.ContentType())
+	if err := out.EncodeBlobInfo(w, info); err != nil {
 		rpc.log.Err(err).Info("can't send blob to client")
 		return
 	}
 }
+
+// repairQuery parses who is asking for a repair, and how many
+// replicas it keeps.
+func repairQuery(q url.Values) (cluster.Node, int, error) {
+	with := cluster.Node{Addr: q.Get("with")}
+	if with.Addr == "" {
+		return with, 0, fmt.Errorf("missing peer")
+	}
+	replicas, err := strconv.Atoi(q.Get("replicas"))
+	if err != nil {
+		return with, 0, fmt.Errorf("invalid replicas: %v", err)
+	}
+	return with, replicas, nil
+}
+
+func (rpc *rpcServer) Digest(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	with, replicas, err := repairQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+
+	d, err := rpc.repair.Digest(ctx, with, replicas)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	w.Header().Set("Content-Type", codec.Binary().ContentType())
+	if err := binary.Write(w, binary.LittleEndian, d); err != nil {
+		rpc.log.Err(err).Info("can't send digest to client")
+		return
+	}
+}
+
+func (rpc *rpcServer) Entries(w http.ResponseWriter, r *http.Request, _ httprouter.Params) {
+	ctx := r.Context()
+
+	with, replicas, err := repairQuery(r.URL.Query())
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	bucket, err := strconv.Atoi(r.URL.Query().Get("bucket"))
+	if err != nil || bucket < 0 || bucket >= digestBuckets {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "invalid bucket %q", r.URL.Query().Get("bucket"))
+		return
+	}
+
+	entries, err := rpc.repair.Entries(ctx, with, replicas, bucket)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "%v", err)
+		return
+	}
+	// repairs are between nodes, which speak binary
+	cd := codec.Binary()
+	w.Header().Set("Content-Type", cd.ContentType())
+	bw := bufio.NewWriter(w)
+	for _, e := range entries {
+		if err := bw.WriteByte(byte(e.Kind)); err != nil {
+			rpc.log.Err(err).Info("can't send entries to client")
+			return
+		}
+		if err := cd.EncodeSum(bw, e.Sum); err != nil {
+			rpc.log.Err(err).Info("can't send entries to client")
+			return
+		}
+	}
+	if err := bw.Flush(); err != nil {
+		rpc.log.Err(err).Info("can't send entries to client")
+		return
+	}
+}
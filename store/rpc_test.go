@@ -0,0 +1,138 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+	"github.com/opentracing-contrib/go-stdlib/nethttp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStore(t *testing.T) {
+	for _, cd := range []codec.Codec{codec.Binary(), codec.JSON(), codec.CBOR()} {
+		t.Run(cd.ContentType(), func(t *testing.T) {
+			var srvs []*httptest.Server
+			defer func() {
+				for _, srv := range srvs {
+					srv.Close()
+				}
+			}()
+			testStore(t, func() merkle.Store {
+				// servers answer clients in the codec they speak
+				srv := httptest.NewServer(HTTPServer(codec.Binary(), NewMemoryStore()))
+				srvs = append(srvs, srv)
+				return httpClient(t, strings.TrimPrefix(srv.URL, "http://"), cd, &http.Client{})
+			})
+		})
+	}
+}
+
+func TestHTTPStoreNegotiation(t *testing.T) {
+	ctx := context.Background()
+	st := NewMemoryStore()
+	h, _ := thash.New(thash.Blake2B512)
+	_, _ = h.Write([]byte("hello world"))
+	sum := thash.MakeSum(h)
+	if err := st.PutBlob(ctx, sum, []byte("hello world")); err != nil {
+		t.Fatal(err)
+	}
+
+	srv := httptest.NewServer(HTTPServer(codec.Binary(), st))
+	defer srv.Close()
+
+	infoBlob := func(body []byte, headers ...string) (*http.Response, string) {
+		req, err := http.NewRequest("GET", srv.URL+"/v1/blobs/info", bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(headers); i += 2 {
+			req.Header.Set(headers[i], headers[i+1])
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		buf := bytes.NewBuffer(nil)
+		_, _ = buf.ReadFrom(resp.Body)
+		return resp, buf.String()
+	}
+	encodeSum := func(cd codec.Codec) []byte {
+		buf := bytes.NewBuffer(nil)
+		if err := cd.EncodeSum(buf, sum); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	// like older clients, that don't say
+	resp, body := infoBlob(encodeSum(codec.Binary()))
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, codec.Binary().ContentType(), resp.Header.Get("Content-Type"))
+	var info merkle.BlobInfo
+	assert.NoError(t, codec.Binary().DecodeBlobInfo(strings.NewReader(body), &info))
+	assert.Equal(t, merkle.BlobInfo{Sum: sum, Size: 11}, info)
+
+	// asked in binary, answered in JSON
+	resp, body = infoBlob(encodeSum(codec.Binary()), "Accept", "text/html, application/json;q=0.9")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	assert.Equal(t, `{"sum":"`+sum.String()+`","size":11}`+"\n", body)
+
+	// asked in JSON, answered in JSON
+	resp, body = infoBlob(encodeSum(codec.JSON()), "Content-Type", "application/json")
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+
+	resp, _ = infoBlob(encodeSum(codec.Binary()), "Content-Type", "text/plain")
+	assert.Equal(t, http.StatusUnsupportedMediaType, resp.StatusCode)
+}
+
+func TestHTTPServerLimits(t *testing.T) {
+	ctx := context.Background()
+	srv := httptest.NewServer(HTTPServer(codec.Binary(codec.WithMaxBlobSize(4)), NewMemoryStore()))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+
+	sum := helloSum()
+	// whichever codec clients speak, the server's limits apply
+	for _, cd := range []codec.Codec{codec.Binary(), codec.JSON(), codec.CBOR()} {
+		err := httpClient(t, addr, cd, &http.Client{}).PutBlob(ctx, sum, []byte("hello world"))
+		assert.Error(t, err, cd.ContentType())
+	}
+
+	// nor can bodies be larger than any request would be
+	body := bytes.Repeat([]byte(" "), 1<<20)
+	req, err := http.NewRequest("PUT", srv.URL+"/v1/nodes", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+}
+
+func TestHTTPClientTLSTransport(t *testing.T) {
+	_, cliTLS := TLSConfigs(nil, nil, false)
+	cl := &http.Client{Transport: &nethttp.Transport{}}
+	_, err := HTTPClient("localhost:0", codec.Binary(), cl, ClientTLS(cliTLS))
+	assert.Error(t, err, "TLS can't be configured on the transport")
+}
+
+func httpClient(t *testing.T, addr string, cd codec.Codec, cl *http.Client, opts ...ClientOption) merkle.StreamStore {
+	st, err := HTTPClient(addr, cd, cl, opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
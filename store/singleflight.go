@@ -2,6 +2,7 @@ package store
 
 import (
 	"context"
+	"strconv"
 
 	"github.com/aybabtme/epher/merkle"
 	"github.com/aybabtme/epher/thash"
@@ -22,7 +23,7 @@ type singlef struct {
 }
 
 func sumKey(sum thash.Sum) string {
-	return string(sum.Type) + "|" + sum.Sum
+	return strconv.Itoa(int(sum.Type)) + "|" + sum.Sum
 }
 
 func (sf *singlef) PutNode(ctx context.Context, node merkle.Node) error {
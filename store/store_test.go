@@ -3,9 +3,11 @@ package store
 import (
 	"bytes"
 	"context"
+	"strings"
 	"testing"
 
 	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -16,6 +18,14 @@ func testStore(t *testing.T, mkStore func() merkle.Store) {
 	}{
 		{"access_by_tree", testStoreByTree},
 		{"access_by_hash_sum", testStoreByHashSum},
+		{"stream_blob", testStoreStreamBlob},
+		{"upgrade_node", testStoreUpgradeNode},
+	}
+	if _, ok := mkStore().(Lister); ok {
+		tests = append(tests, struct {
+			name   string
+			testFn func(t *testing.T, mkStore func() merkle.Store)
+		}{"list", testStoreList})
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
@@ -92,3 +102,133 @@ func testStoreByHashSum(t *testing.T, mkStore func() merkle.Store) {
 
 	assert.Equal(t, want, got)
 }
+
+func testStoreUpgradeNode(t *testing.T, mkStore func() merkle.Store) {
+	ctx := context.Background()
+
+	store := mkStore()
+
+	sum := func(s string) thash.Sum {
+		h, _ := thash.New(thash.Blake2B512)
+		_, _ = h.Write([]byte(s))
+		return thash.MakeSum(h)
+	}
+	legacy := merkle.Node{Start: sum("start"), End: sum("end")}
+	legacy.Sum, _ = merkle.NodeSum(legacy)
+	described := legacy
+	described.StartKind, described.StartSize = merkle.BlobChild, 5
+	described.EndKind, described.EndSize = merkle.BlobChild, 3
+
+	for _, put := range []merkle.Node{legacy, described, legacy} {
+		if err := store.PutNode(ctx, put); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, found, err := store.GetNode(ctx, legacy.Sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, found)
+	assert.Equal(t, described, got)
+}
+
+// testStoreReplaceNode checks that a node that describes its children
+// wrongly can be replaced. Only stores that apply puts in order can
+// tell which came last.
+func testStoreReplaceNode(t *testing.T, store merkle.Store) {
+	ctx := context.Background()
+
+	tree, _, err := merkle.Build(ctx, strings.NewReader("hello world"), store, merkle.WithBlobSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	described := nodeOf(tree)
+	wrong := described
+	wrong.EndSize++
+
+	for _, put := range []merkle.Node{wrong, described} {
+		if err := store.PutNode(ctx, put); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, found, err := store.GetNode(ctx, described.Sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.True(t, found)
+	assert.Equal(t, described, got)
+}
+
+func testStoreStreamBlob(t *testing.T, mkStore func() merkle.Store) {
+	ctx := context.Background()
+
+	store := merkle.Streaming(mkStore())
+
+	want := bytes.Repeat([]byte("0123456789"), 1<<16)
+	h, _ := thash.New(thash.Blake2B512)
+	_, _ = h.Write(want)
+	sum := thash.MakeSum(h)
+
+	err := store.PutBlobStream(ctx, sum, int64(len(want)), bytes.NewReader(want))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := bytes.NewBuffer(nil)
+	found, err := store.GetBlobStream(ctx, sum, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("blob should have been found")
+	}
+	assert.Equal(t, want, buf.Bytes())
+
+	info, found, err := store.InfoBlob(ctx, sum)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !found {
+		t.Fatal("blob should have been found")
+	}
+	assert.Equal(t, int64(len(want)), info.Size)
+}
+
+func testStoreList(t *testing.T, mkStore func() merkle.Store) {
+	ctx := context.Background()
+
+	store := mkStore()
+
+	tree, _, err := merkle.Build(
+		ctx,
+		bytes.NewReader([]byte("123456789")),
+		store,
+		merkle.WithBlobSize(2),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := make(map[Entry]bool)
+	var walk func(tree *merkle.Tree)
+	walk = func(tree *merkle.Tree) {
+		if tree.Start == nil || tree.End == nil {
+			want[Entry{Kind: BlobKind, Sum: tree.HashSum}] = true
+			return
+		}
+		want[Entry{Kind: NodeKind, Sum: tree.HashSum}] = true
+		walk(tree.Start)
+		walk(tree.End)
+	}
+	walk(tree)
+
+	got := make(map[Entry]bool)
+	err = store.(Lister).List(ctx, func(e Entry) error {
+		got[e] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+}
@@ -0,0 +1,73 @@
+package store
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// TLSConfigs makes the configs of the servers and clients of a cluster
+// whose certificates are issued by cas. Servers present cert, as do
+// clients when it isn't nil. With mutual, servers refuse clients that
+// don't present a certificate issued by cas. Certificates are verified
+// against the roots of the host when cas is nil.
+func TLSConfigs(cert *tls.Certificate, cas *x509.CertPool, mutual bool) (server, client *tls.Config) {
+	server = &tls.Config{MinVersion: tls.VersionTLS12}
+	client = &tls.Config{MinVersion: tls.VersionTLS12, RootCAs: cas}
+	if cert != nil {
+		server.Certificates = []tls.Certificate{*cert}
+		client.Certificates = []tls.Certificate{*cert}
+	}
+	if mutual {
+		server.ClientAuth = tls.RequireAndVerifyClientCert
+		server.ClientCAs = cas
+	}
+	return server, client
+}
+
+// LoadTLS makes the configs of TLSConfigs from PEM files. The
+// certificate and the authorities are optional, but mutual TLS needs
+// both.
+func LoadTLS(certFile, keyFile, caFile string, mutual bool) (server, client *tls.Config, err error) {
+	var cert *tls.Certificate
+	if certFile != "" || keyFile != "" {
+		c, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cert = &c
+	}
+	var cas *x509.CertPool
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cas = x509.NewCertPool()
+		if !cas.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificates in %q", caFile)
+		}
+	}
+	if mutual && (cert == nil || cas == nil) {
+		return nil, nil, errors.New("mutual TLS needs a certificate and the authorities that issue them")
+	}
+	server, client = TLSConfigs(cert, cas, mutual)
+	return server, client, nil
+}
+
+func withTLS(rt http.RoundTripper, config *tls.Config) (http.RoundTripper, error) {
+	var tr *http.Transport
+	switch t := rt.(type) {
+	case nil:
+		tr = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		tr = t.Clone()
+	default:
+		return nil, fmt.Errorf("can't configure TLS on a %T transport", rt)
+	}
+	tr.TLSClientConfig = config
+	return tr, nil
+}
@@ -0,0 +1,191 @@
+package store
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHTTPStoreTLS(t *testing.T) {
+	ca := newTestCA(t, "cluster")
+	srvTLS, cliTLS := TLSConfigs(ca.issue(t, "node"), ca.pool(), false)
+
+	var srvs []*httptest.Server
+	defer func() {
+		for _, srv := range srvs {
+			srv.Close()
+		}
+	}()
+	testStore(t, func() merkle.Store {
+		srv := startTLSServer(srvTLS)
+		srvs = append(srvs, srv)
+		return httpClient(t, strings.TrimPrefix(srv.URL, "https://"), codec.Binary(), &http.Client{}, ClientTLS(cliTLS))
+	})
+
+	// clients that don't trust the authority of the cluster don't talk
+	// to its nodes
+	srv := startTLSServer(srvTLS)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+	sum := helloSum()
+	_, cliTLS = TLSConfigs(nil, newTestCA(t, "other").pool(), false)
+	_, _, err := httpClient(t, addr, codec.Binary(), &http.Client{}, ClientTLS(cliTLS)).InfoBlob(context.Background(), sum)
+	assert.Error(t, err)
+	_, _, err = httpClient(t, addr, codec.Binary(), &http.Client{}).InfoBlob(context.Background(), sum)
+	assert.Error(t, err, "spoke clear text to a TLS server")
+}
+
+func TestHTTPStoreMutualTLS(t *testing.T) {
+	ctx := context.Background()
+	ca := newTestCA(t, "cluster")
+	srvTLS, cliTLS := TLSConfigs(ca.issue(t, "node"), ca.pool(), true)
+
+	srv := startTLSServer(srvTLS)
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "https://")
+
+	sum := helloSum()
+	member := httpClient(t, addr, codec.Binary(), &http.Client{}, ClientTLS(cliTLS))
+	assert.NoError(t, member.PutBlob(ctx, sum, []byte("hello world")))
+	_, found, err := member.InfoBlob(ctx, sum)
+	assert.NoError(t, err)
+	assert.True(t, found)
+
+	// clients without a certificate of the cluster are refused
+	_, anonymous := TLSConfigs(nil, ca.pool(), false)
+	_, outsider := TLSConfigs(newTestCA(t, "other").issue(t, "node"), ca.pool(), false)
+	for name, config := range map[string]*tls.Config{"anonymous": anonymous, "outsider": outsider} {
+		_, _, err := httpClient(t, addr, codec.Binary(), &http.Client{}, ClientTLS(config)).InfoBlob(ctx, sum)
+		assert.Error(t, err, name)
+	}
+}
+
+func TestLoadTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "epher_tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, "cluster")
+	cert := ca.issue(t, "node")
+	key, err := x509.MarshalECPrivateKey(cert.PrivateKey.(*ecdsa.PrivateKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM := func(name, typ string, der []byte) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	certFile := writePEM("node.pem", "CERTIFICATE", cert.Certificate[0])
+	keyFile := writePEM("node-key.pem", "EC PRIVATE KEY", key)
+	caFile := writePEM("ca.pem", "CERTIFICATE", ca.cert.Raw)
+
+	srvTLS, cliTLS, err := LoadTLS(certFile, keyFile, caFile, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := startTLSServer(srvTLS)
+	defer srv.Close()
+	cl := httpClient(t, strings.TrimPrefix(srv.URL, "https://"), codec.Binary(), &http.Client{}, ClientTLS(cliTLS))
+	_, _, err = cl.InfoBlob(context.Background(), helloSum())
+	assert.NoError(t, err)
+
+	_, _, err = LoadTLS("", "", caFile, true)
+	assert.Error(t, err, "mutual TLS without a certificate")
+}
+
+func helloSum() thash.Sum {
+	h, _ := thash.New(thash.Blake2B512)
+	_, _ = h.Write([]byte("hello world"))
+	return thash.MakeSum(h)
+}
+
+func startTLSServer(config *tls.Config) *httptest.Server {
+	srv := httptest.NewUnstartedServer(HTTPServer(codec.Binary(), NewMemoryStore()))
+	srv.TLS = config
+	srv.StartTLS()
+	return srv
+}
+
+// testCA is a certificate authority that issues certificates for
+// 127.0.0.1.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+func (ca *testCA) pool() *x509.CertPool {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	return pool
+}
+
+func (ca *testCA) issue(t *testing.T, name string) *tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
@@ -0,0 +1,267 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+)
+
+// MismatchError is returned when a blob or node doesn't hash to the sum
+// it's put or gotten under.
+type MismatchError struct {
+	Sum thash.Sum
+	// Got is what it hashes to, unknown when a remote store refused it
+	// or when a node describes its children wrongly.
+	Got thash.Sum
+}
+
+func (me *MismatchError) Error() string {
+	if me.Got == (thash.Sum{}) {
+		return fmt.Sprintf("content doesn't match sum %v", me.Sum)
+	}
+	return fmt.Sprintf("content of sum %v hashes to %v", me.Sum, me.Got)
+}
+
+// VerifyOption configures a store made by Verify.
+type VerifyOption func(*verify)
+
+// VerifyGets also verifies what is gotten from the store, not only what
+// is put in it.
+func VerifyGets() VerifyOption {
+	return func(v *verify) { v.gets = true }
+}
+
+// VerifyChildrenIn looks up the children of nodes in children instead
+// of the verified store, to check how nodes describe them.
+func VerifyChildrenIn(children merkle.Store) VerifyOption {
+	return func(v *verify) { v.children = children }
+}
+
+// VerifyHashKey gives the key of keyed sums.
+func VerifyHashKey(key []byte) VerifyOption {
+	return func(v *verify) { v.key = key }
+}
+
+// Verify refuses to put blobs and nodes in store unless they hash to
+// their sum, with a MismatchError. Nodes must hash to the sum of their
+// children. Keyed sums can't be verified without their key, and are
+// let through when it isn't given.
+//
+// Without domain separation, the sum of a node doesn't cover the
+// description of its children. Nodes must then give the right size to
+// the children that store has as the kind they're described as.
+func Verify(store merkle.Store, opts ...VerifyOption) merkle.StreamStore {
+	v := &verify{store: merkle.Streaming(store), children: store}
+	for _, opt := range opts {
+		opt(v)
+	}
+	return v
+}
+
+type verify struct {
+	store    merkle.StreamStore
+	children merkle.Store
+	gets     bool
+	key      []byte
+}
+
+// canVerify tells if sums of type t can be verified.
+func (v *verify) canVerify(t thash.Type) bool {
+	return t&thash.Keyed == 0 || len(v.key) != 0
+}
+
+func (v *verify) hashOpts() []merkle.Option {
+	if len(v.key) == 0 {
+		return nil
+	}
+	return []merkle.Option{merkle.WithHashKey(v.key)}
+}
+
+func (v *verify) checkNode(sum thash.Sum, node merkle.Node) error {
+	if !v.canVerify(sum.Type) {
+		return nil
+	}
+	got, err := merkle.NodeSum(node, v.hashOpts()...)
+	if err != nil {
+		return err
+	}
+	if !sum.Equal(got) || !sum.Equal(node.Sum) {
+		return &MismatchError{Sum: sum, Got: got}
+	}
+	return nil
+}
+
+// checkDescription compares what a node says of its children with
+// those of its children that the store has.
+func (v *verify) checkDescription(ctx context.Context, node merkle.Node) error {
+	if !node.Described() || node.Sum.Type&thash.DomainSeparated != 0 {
+		return nil
+	}
+	children := []struct {
+		sum  thash.Sum
+		kind merkle.ChildKind
+		size int64
+	}{
+		{node.Start, node.StartKind, node.StartSize},
+		{node.End, node.EndKind, node.EndSize},
+	}
+	for _, child := range children {
+		ok, err := v.isChild(ctx, child.sum, child.kind, child.size)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return &MismatchError{Sum: node.Sum}
+		}
+	}
+	return nil
+}
+
+// isChild tells if the child under sum can be of that kind and size,
+// which it can be unless the store has it as that kind but of another
+// size. Children are only looked up as what they're described as.
+func (v *verify) isChild(ctx context.Context, sum thash.Sum, kind merkle.ChildKind, size int64) (bool, error) {
+	switch kind {
+	case merkle.BlobChild:
+		info, found, err := v.children.InfoBlob(ctx, sum)
+		if err != nil || !found {
+			return err == nil, err
+		}
+		return info.Size == size, nil
+	case merkle.NodeChild:
+		node, found, err := v.children.GetNode(ctx, sum)
+		if err != nil || !found {
+			return err == nil, err
+		}
+		return !node.Described() || node.Size() == size, nil
+	}
+	return false, nil
+}
+
+func (v *verify) checkBlob(sum thash.Sum, data []byte) error {
+	if !v.canVerify(sum.Type) {
+		return nil
+	}
+	h, err := merkle.BlobHash(sum.Type, int64(len(data)), v.hashOpts()...)
+	if err != nil {
+		return err
+	}
+	_, _ = h.Write(data)
+	if got := thash.MakeSum(h); !sum.Equal(got) {
+		return &MismatchError{Sum: sum, Got: got}
+	}
+	return nil
+}
+
+func (v *verify) PutNode(ctx context.Context, node merkle.Node) error {
+	if err := v.checkNode(node.Sum, node); err != nil {
+		return err
+	}
+	if err := v.checkDescription(ctx, node); err != nil {
+		return err
+	}
+	return v.store.PutNode(ctx, node)
+}
+
+func (v *verify) GetNode(ctx context.Context, sum thash.Sum) (merkle.Node, bool, error) {
+	node, found, err := v.store.GetNode(ctx, sum)
+	if err != nil || !found || !v.gets {
+		return node, found, err
+	}
+	if err := v.checkNode(sum, node); err != nil {
+		return merkle.Node{}, false, err
+	}
+	return node, true, nil
+}
+
+func (v *verify) PutBlob(ctx context.Context, sum thash.Sum, data []byte) error {
+	if err := v.checkBlob(sum, data); err != nil {
+		return err
+	}
+	return v.store.PutBlob(ctx, sum, data)
+}
+
+func (v *verify) GetBlob(ctx context.Context, sum thash.Sum) ([]byte, bool, error) {
+	data, found, err := v.store.GetBlob(ctx, sum)
+	if err != nil || !found || !v.gets {
+		return data, found, err
+	}
+	if err := v.checkBlob(sum, data); err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (v *verify) InfoBlob(ctx context.Context, sum thash.Sum) (merkle.BlobInfo, bool, error) {
+	return v.store.InfoBlob(ctx, sum)
+}
+
+// PutBlobStream hashes the blob as the store reads it. A blob that
+// doesn't match its sum fails the last read, so the store doesn't keep
+// it.
+func (v *verify) PutBlobStream(ctx context.Context, sum thash.Sum, size int64, r io.Reader) error {
+	if !v.canVerify(sum.Type) {
+		return v.store.PutBlobStream(ctx, sum, size, r)
+	}
+	if size == 0 {
+		return v.PutBlob(ctx, sum, nil)
+	}
+	h, err := merkle.BlobHash(sum.Type, size, v.hashOpts()...)
+	if err != nil {
+		return err
+	}
+	return v.store.PutBlobStream(ctx, sum, size, &verifyReader{r: r, h: h, sum: sum, left: size})
+}
+
+// GetBlobStream can only tell that a blob doesn't match its sum once
+// it's been written to w.
+func (v *verify) GetBlobStream(ctx context.Context, sum thash.Sum, w io.Writer) (bool, error) {
+	if !v.gets || !v.canVerify(sum.Type) {
+		return v.store.GetBlobStream(ctx, sum, w)
+	}
+	info, found, err := v.store.InfoBlob(ctx, sum)
+	if err != nil || !found {
+		return found, err
+	}
+	h, err := merkle.BlobHash(sum.Type, info.Size, v.hashOpts()...)
+	if err != nil {
+		return false, err
+	}
+	found, err = v.store.GetBlobStream(ctx, sum, io.MultiWriter(w, h))
+	if err != nil || !found {
+		return found, err
+	}
+	if got := thash.MakeSum(h); !sum.Equal(got) {
+		return false, &MismatchError{Sum: sum, Got: got}
+	}
+	return true, nil
+}
+
+// verifyReader fails the read that completes a blob, unless the blob
+// matches its sum. The bytes of that read are held back, so that
+// io.CopyN doesn't take the blob to be complete.
+type verifyReader struct {
+	r    io.Reader
+	h    thash.Hash
+	sum  thash.Sum
+	left int64
+}
+
+func (vr *verifyReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > vr.left {
+		p = p[:vr.left]
+	}
+	n, err := vr.r.Read(p)
+	_, _ = vr.h.Write(p[:n])
+	vr.left -= int64(n)
+	if vr.left == 0 {
+		if got := thash.MakeSum(vr.h); !vr.sum.Equal(got) {
+			return 0, &MismatchError{Sum: vr.sum, Got: got}
+		}
+		return n, io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,210 @@
+package store
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/aybabtme/epher/codec"
+	"github.com/aybabtme/epher/merkle"
+	"github.com/aybabtme/epher/thash"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyStore(t *testing.T) {
+	testStore(t, func() merkle.Store {
+		return Verify(NewMemoryStore(), VerifyGets())
+	})
+}
+
+func TestVerifyRefusesMismatches(t *testing.T) {
+	ctx := context.Background()
+
+	dir, err := ioutil.TempDir("", "epher_verify_store")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs := mustFSStore(t, dir)
+
+	mem := NewMemoryStore()
+	srv := httptest.NewServer(HTTPServer(codec.Binary(), Verify(mem)))
+	defer srv.Close()
+	remote := httpClient(t, strings.TrimPrefix(srv.URL, "http://"), codec.Binary(), &http.Client{})
+
+	for name, st := range map[string]merkle.StreamStore{
+		"memory": Verify(NewMemoryStore()),
+		"fs":     Verify(fs),
+		"http":   remote,
+	} {
+		tree, _, err := merkle.Build(ctx, strings.NewReader("hello world"), NewMemoryStore(),
+			merkle.WithBlobSize(4),
+			merkle.WithDomainSeparation(),
+		)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blob, node := firstBlob(tree), nodeOf(tree)
+
+		var mismatch *MismatchError
+		err = st.PutBlob(ctx, blob.HashSum, []byte("nope"))
+		assert.True(t, errors.As(err, &mismatch), "%s: %v", name, err)
+		err = st.PutBlobStream(ctx, blob.HashSum, 4, strings.NewReader("nope"))
+		assert.True(t, errors.As(err, &mismatch), "%s: %v", name, err)
+		_, found, err := st.GetBlob(ctx, blob.HashSum)
+		assert.NoError(t, err, name)
+		assert.False(t, found, "%s: a blob that doesn't match its sum was kept", name)
+
+		// the description of children is part of the sum of the node
+		bad := node
+		bad.StartSize++
+		err = st.PutNode(ctx, bad)
+		assert.True(t, errors.As(err, &mismatch), "%s: %v", name, err)
+		bad = node
+		bad.StartKind = flipKind(bad.StartKind)
+		err = st.PutNode(ctx, bad)
+		assert.True(t, errors.As(err, &mismatch), "%s: %v", name, err)
+
+		assert.NoError(t, st.PutBlob(ctx, blob.HashSum, []byte("hell")), name)
+		assert.NoError(t, st.PutNode(ctx, node), name)
+	}
+	assert.Equal(t, int64(4), mem.(*MemoryStore).SizeByte())
+}
+
+func TestVerifyDescriptions(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryStore()
+
+	tree, _, err := merkle.Build(ctx, strings.NewReader("hello world"), mem, merkle.WithBlobSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// children are only looked up as what they're described as
+	var lookups []string
+	st := Verify(&intercept{
+		around: func(ctx context.Context, method string, fn func(context.Context) error) error {
+			lookups = append(lookups, method)
+			return fn(ctx)
+		},
+		wrap: mem,
+	})
+	node := nodeOf(tree)
+	assert.Equal(t, merkle.BlobChild, node.StartKind)
+	assert.Equal(t, merkle.NodeChild, node.EndKind)
+
+	var mismatch *MismatchError
+	for _, bad := range []merkle.Node{
+		func() merkle.Node { n := node; n.StartSize++; return n }(),
+		func() merkle.Node { n := node; n.EndSize--; return n }(),
+	} {
+		err := st.PutNode(ctx, bad)
+		assert.True(t, errors.As(err, &mismatch), "%+v: %v", bad, err)
+	}
+	lookups = nil
+	assert.NoError(t, st.PutNode(ctx, node))
+	assert.Equal(t, []string{"InfoBlob", "GetNode", "PutNode"}, lookups)
+
+	// children that aren't in the store can't be checked
+	assert.NoError(t, Verify(NewMemoryStore()).PutNode(ctx, node))
+
+	// unless they're looked up elsewhere
+	bad := node
+	bad.StartSize--
+	err = Verify(NewMemoryStore(), VerifyChildrenIn(mem)).PutNode(ctx, bad)
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+}
+
+func TestVerifyKeyed(t *testing.T) {
+	ctx := context.Background()
+	key := []byte("a key")
+
+	tree, _, err := merkle.Build(ctx, strings.NewReader("hello world"), NewMemoryStore(),
+		merkle.WithBlobSize(4),
+		merkle.WithHashType(thash.Blake2B256),
+		merkle.WithHashKey(key),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := firstBlob(tree)
+
+	// without the key, keyed sums can't be verified
+	assert.NoError(t, Verify(NewMemoryStore()).PutBlob(ctx, blob.HashSum, []byte("nope")))
+
+	st := Verify(NewMemoryStore(), VerifyHashKey(key))
+	var mismatch *MismatchError
+	err = st.PutBlob(ctx, blob.HashSum, []byte("nope"))
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	assert.NoError(t, st.PutBlob(ctx, blob.HashSum, []byte("hell")))
+	assert.NoError(t, st.PutNode(ctx, nodeOf(tree)))
+}
+
+func TestVerifyGets(t *testing.T) {
+	ctx := context.Background()
+	mem := NewMemoryStore()
+
+	tree, _, err := merkle.Build(ctx, strings.NewReader("hello world"), mem, merkle.WithBlobSize(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	blob := firstBlob(tree)
+	corrupt := mem.(*MemoryStore)
+	corrupt.shard(blob.HashSum).data[blob.HashSum] = []byte("nope")
+	corrupt.shard(tree.HashSum).node[tree.HashSum] = merkle.Node{Sum: tree.HashSum, Start: blob.HashSum, End: blob.HashSum}
+
+	var mismatch *MismatchError
+	st := Verify(mem, VerifyGets())
+	_, _, err = st.GetBlob(ctx, blob.HashSum)
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	_, err = st.GetBlobStream(ctx, blob.HashSum, ioutil.Discard)
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+	_, _, err = st.GetNode(ctx, tree.HashSum)
+	assert.True(t, errors.As(err, &mismatch), "%v", err)
+
+	// gets aren't verified unless asked
+	data, found, err := Verify(mem).GetBlob(ctx, blob.HashSum)
+	assert.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("nope"), data)
+	buf := bytes.NewBuffer(nil)
+	_, err = Verify(mem).GetBlobStream(ctx, blob.HashSum, buf)
+	assert.NoError(t, err)
+}
+
+func firstBlob(tree *merkle.Tree) *merkle.Tree {
+	for tree.Start != nil {
+		tree = tree.Start
+	}
+	return tree
+}
+
+func nodeOf(tree *merkle.Tree) merkle.Node {
+	kind := func(child *merkle.Tree) merkle.ChildKind {
+		if child.Start == nil {
+			return merkle.BlobChild
+		}
+		return merkle.NodeChild
+	}
+	return merkle.Node{
+		Sum:       tree.HashSum,
+		Start:     tree.Start.HashSum,
+		End:       tree.End.HashSum,
+		StartKind: kind(tree.Start),
+		EndKind:   kind(tree.End),
+		StartSize: tree.Start.SizeByte,
+		EndSize:   tree.End.SizeByte,
+	}
+}
+
+func flipKind(kind merkle.ChildKind) merkle.ChildKind {
+	if kind == merkle.BlobChild {
+		return merkle.NodeChild
+	}
+	return merkle.BlobChild
+}
@@ -1,10 +1,13 @@
 package thash
 
 import (
-	"hash"
-
+	"crypto/sha256"
+	"errors"
 	"fmt"
+	"hash"
+	"strconv"
 
+	"github.com/zeebo/blake3"
 	"golang.org/x/crypto/blake2b"
 	"golang.org/x/crypto/sha3"
 )
@@ -14,8 +17,62 @@ type Type uint16
 const (
 	Blake2B512 Type = iota + 1
 	SHA3
+	SHA256
+	Blake2B256
+	// Blake3 is BLAKE3 with its default, 256 bits output.
+	Blake3
 )
 
+// DomainSeparated is a flag set on the type of the sums of trees whose
+// blobs and nodes are hashed with distinct prefixes. Such sums are
+// computed with the same hash function, but never equal the sums of
+// trees hashed without.
+const DomainSeparated Type = 1 << 15
+
+// Keyed is a flag set on the type of sums computed with a secret key,
+// see NewKeyed. Only the BLAKE2b types can be keyed.
+const Keyed Type = 1 << 14
+
+// Func is the hash function used by sums of this type, without flags.
+func (t Type) Func() Type { return t &^ (DomainSeparated | Keyed) }
+
+func (t Type) String() string {
+	var s string
+	switch t.Func() {
+	case Blake2B512:
+		s = "blake2b-512"
+	case SHA3:
+		s = "sha3-512"
+	case SHA256:
+		s = "sha2-256"
+	case Blake2B256:
+		s = "blake2b-256"
+	case Blake3:
+		s = "blake3"
+	default:
+		s = "Type(" + strconv.Itoa(int(t.Func())) + ")"
+	}
+	if t&Keyed != 0 {
+		s += "+keyed"
+	}
+	if t&DomainSeparated != 0 {
+		s += "+separated"
+	}
+	return s
+}
+
+// Size is the number of bytes of the sums of this type, or 0 for
+// unknown types.
+func (t Type) Size() int {
+	switch t.Func() {
+	case Blake2B512, SHA3:
+		return 64
+	case SHA256, Blake2B256, Blake3:
+		return 32
+	}
+	return 0
+}
+
 type Sum struct {
 	Type Type
 	Sum  string
@@ -44,21 +101,58 @@ type typedHash struct {
 
 func (h *typedHash) Type() Type { return h.t }
 
-func New(ht Type) Hash {
+var errNeedsKey = errors.New("keyed hash types need a key")
+
+// New returns a hash of the given type. Keyed types need NewKeyed.
+func New(ht Type) (Hash, error) {
+	if ht&Keyed != 0 {
+		return nil, errNeedsKey
+	}
 	var (
 		h   hash.Hash
 		err error
 	)
-	switch ht {
+	switch ht.Func() {
 	case Blake2B512:
 		h, err = blake2b.New512(nil)
+	case Blake2B256:
+		h, err = blake2b.New256(nil)
 	case SHA3:
 		h = sha3.New512()
+	case SHA256:
+		h = sha256.New()
+	case Blake3:
+		h = blake3.New()
+	default:
+		return nil, fmt.Errorf("not a valid hash type: %v", ht)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &typedHash{Hash: h, t: ht}, nil
+}
+
+// NewKeyed returns a BLAKE2b hash of the given type, a MAC keyed with
+// key. The Keyed flag is added to the type. Keys are at most 64 bytes.
+func NewKeyed(ht Type, key []byte) (Hash, error) {
+	if len(key) == 0 {
+		return nil, errNeedsKey
+	}
+	ht |= Keyed
+	var (
+		h   hash.Hash
+		err error
+	)
+	switch ht.Func() {
+	case Blake2B512:
+		h, err = blake2b.New512(key)
+	case Blake2B256:
+		h, err = blake2b.New256(key)
 	default:
-		panic(fmt.Sprintf("not a valid type: %v", ht))
+		return nil, fmt.Errorf("hash type %v can't be keyed", ht)
 	}
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	return &typedHash{Hash: h, t: ht}
+	return &typedHash{Hash: h, t: ht}, nil
 }
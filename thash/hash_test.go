@@ -0,0 +1,90 @@
+package thash
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNew(t *testing.T) {
+	tests := []struct {
+		typ  Type
+		want string // of "abc"
+	}{
+		{SHA256, "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"},
+		{Blake3, "6437b3ac38465133ffb63b75273a8db548c558465d79db03fd359c6cd5bd9d85"},
+		{Blake2B256, "bddd813c634239723171ef3fee98579b94964e3bb1cb3e427262c8c068d52319"},
+		{Blake2B512, "ba80a53f981c4d0d6a2797b69f12f6e94c212f14685ac4b74b12bb6fdbffa2d17d87c5392aab792dc252d5de4533cc9518d38aa8dbf1925ab92386edd4009923"},
+		{SHA3, "b751850b1a57168a5693cd924b6b096e08f621827444f70d884f5d0240d2712e10e116e9192af3c91a7ec57647e3934057340b4cf408d5a56592f8274eec53f0"},
+	}
+	for _, tt := range tests {
+		h, err := New(tt.typ)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = h.Write([]byte("abc"))
+		sum := MakeSum(h)
+		assert.Equal(t, tt.typ, sum.Type, tt.typ.String())
+		assert.Equal(t, tt.want, hex.EncodeToString([]byte(sum.Sum)), tt.typ.String())
+		assert.Equal(t, tt.typ.Size(), len(sum.Sum), tt.typ.String())
+	}
+
+	_, err := New(Type(42))
+	assert.Error(t, err)
+	_, err = New(Blake2B256 | Keyed)
+	assert.Error(t, err)
+}
+
+// from the test vectors published with the BLAKE3 reference
+// implementation, whose inputs are the bytes 0, 1, ..., 250, 0, 1, ...
+func TestBlake3Vectors(t *testing.T) {
+	tests := []struct {
+		len  int
+		want string
+	}{
+		{0, "af1349b9f5f9a1a6a0404dea36dcc9499bcb25c9adc112b7cc9a93cae41f3262"},
+		{1, "2d3adedff11b61f14c886e35afa036736dcd87a74d27b5c1510225d0f592e213"},
+		{1023, "10108970eeda3eb932baac1428c7a2163b0e924c9a9e25b35bba72b28f70bd11"},
+		{1024, "42214739f095a406f3fc83deb889744ac00df831c10daa55189b5d121c855af7"},
+		{1025, "d00278ae47eb27b34faecf67b4fe263f82d5412916c1ffd97c8cb7fb814b8444"},
+		{3073, "7124b49501012f81cc7f11ca069ec9226cecb8a2c850cfe644e327d22d3e1cd3"},
+		{8193, "bab6c09cb8ce8cf459261398d2e7aef35700bf488116ceb94a36d0f5f1b7bc3b"},
+		{31744, "62b6960e1a44bcc1eb1a611a8d6235b6b4b78f32e7abc4fb4c6cdcce94895c47"},
+	}
+	for _, tt := range tests {
+		input := make([]byte, tt.len)
+		for i := range input {
+			input[i] = byte(i % 251)
+		}
+		h, err := New(Blake3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = h.Write(input)
+		assert.Equal(t, tt.want, hex.EncodeToString(h.Sum(nil)), "len=%d", tt.len)
+	}
+}
+
+func TestNewKeyed(t *testing.T) {
+	sum := func(typ Type, key string) Sum {
+		h, err := NewKeyed(typ, []byte(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = h.Write([]byte("abc"))
+		return MakeSum(h)
+	}
+	a, b := sum(Blake2B256, "a key"), sum(Blake2B256, "another key")
+	assert.Equal(t, Blake2B256|Keyed, a.Type)
+	assert.Equal(t, Blake2B256, a.Type.Func())
+	assert.NotEqual(t, a.Sum, b.Sum)
+	assert.Equal(t, a, sum(Blake2B256|Keyed, "a key"))
+
+	_, err := NewKeyed(SHA256, []byte("a key"))
+	assert.Error(t, err)
+	_, err = NewKeyed(Blake2B512, nil)
+	assert.Error(t, err)
+	_, err = NewKeyed(Blake2B512, make([]byte, 65))
+	assert.Error(t, err)
+}
@@ -0,0 +1,200 @@
+package thash
+
+import (
+	"encoding"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// The binary form of a sum is a CIDv1:
+//
+//	version || codec || multihash
+//
+// The multihash tells the hash function and the digest. The codec is
+// epherCodec, in the private range of the multicodec table, plus the
+// flags of the type. The text form is the multibase encoding of the
+// binary form in lowercase base32, prefixed with a 'b'.
+const (
+	cidVersion = 1
+	epherCodec = 0x300000
+
+	flagShift = 14 // of DomainSeparated and Keyed
+)
+
+// multihash codes of the hash functions, from the multicodec table
+var multihashCodes = map[Type]uint64{
+	Blake2B512: 0xb240,
+	SHA3:       0x14,
+	SHA256:     0x12,
+	Blake2B256: 0xb220,
+	Blake3:     0x1e,
+}
+
+var base32Lower = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+var (
+	_ encoding.TextMarshaler     = Sum{}
+	_ encoding.TextUnmarshaler   = (*Sum)(nil)
+	_ encoding.BinaryMarshaler   = Sum{}
+	_ encoding.BinaryUnmarshaler = (*Sum)(nil)
+)
+
+// String is the text form of the sum, or a description of it when it
+// has no text form.
+func (sum Sum) String() string {
+	text, err := sum.MarshalText()
+	if err != nil {
+		return fmt.Sprintf("Sum(%v:%x)", sum.Type, sum.Sum)
+	}
+	return string(text)
+}
+
+// MarshalText encodes the sum in its text form. The zero sum is empty.
+func (sum Sum) MarshalText() ([]byte, error) {
+	buf, err := sum.MarshalBinary()
+	if err != nil || len(buf) == 0 {
+		return buf, err
+	}
+	text := make([]byte, 1+base32Lower.EncodedLen(len(buf)))
+	text[0] = 'b'
+	base32Lower.Encode(text[1:], buf)
+	return text, nil
+}
+
+// MarshalBinary encodes the sum as the bytes of a CID. The zero sum is
+// empty.
+func (sum Sum) MarshalBinary() ([]byte, error) {
+	if sum.Type == 0 && sum.Sum == "" {
+		return []byte{}, nil
+	}
+	code, ok := multihashCodes[sum.Type.Func()]
+	if !ok {
+		return nil, fmt.Errorf("sums of type %v have no text form", sum.Type)
+	}
+	flags := uint64(sum.Type&^sum.Type.Func()) >> flagShift
+
+	buf := make([]byte, 0, 4*binary.MaxVarintLen64+len(sum.Sum))
+	buf = appendUvarint(buf, cidVersion)
+	buf = appendUvarint(buf, epherCodec+flags)
+	buf = appendUvarint(buf, code)
+	buf = appendUvarint(buf, uint64(len(sum.Sum)))
+	buf = append(buf, sum.Sum...)
+	return buf, nil
+}
+
+// UnmarshalBinary decodes a sum from the bytes of a CID.
+func (sum *Sum) UnmarshalBinary(buf []byte) error {
+	if len(buf) == 0 {
+		*sum = Sum{}
+		return nil
+	}
+	parsed, err := parseCID(buf)
+	if err != nil {
+		return fmt.Errorf("invalid sum %x: %v", buf, err)
+	}
+	*sum = parsed
+	return nil
+}
+
+// UnmarshalText decodes a sum from its text form.
+func (sum *Sum) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*sum = Sum{}
+		return nil
+	}
+	parsed, err := ParseSum(string(text))
+	if err != nil {
+		return err
+	}
+	*sum = parsed
+	return nil
+}
+
+// ParseSum parses the text form of a sum. It also accepts the form
+// "<type>:<hex>" that was printed by the command line before sums had a
+// text form.
+func ParseSum(str string) (Sum, error) {
+	if i := strings.IndexByte(str, ':'); i >= 0 {
+		return parseLegacySum(str[:i], str[i+1:])
+	}
+	if str == "" {
+		return Sum{}, errors.New("empty sum")
+	}
+	var (
+		buf []byte
+		err error
+	)
+	switch str[0] {
+	case 'b':
+		buf, err = base32Lower.DecodeString(str[1:])
+	case 'B':
+		buf, err = base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(str[1:])
+	case 'f':
+		buf, err = hex.DecodeString(str[1:])
+	default:
+		return Sum{}, fmt.Errorf("sum %q has an unsupported multibase prefix %q", str, str[0])
+	}
+	if err == nil {
+		var sum Sum
+		sum, err = parseCID(buf)
+		if err == nil {
+			return sum, nil
+		}
+	}
+	return Sum{}, fmt.Errorf("invalid sum %q: %v", str, err)
+}
+
+func parseCID(buf []byte) (Sum, error) {
+	var fields [4]uint64 // version, codec, multihash code and length
+	for i := range fields {
+		v, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return Sum{}, errors.New("truncated")
+		}
+		fields[i], buf = v, buf[n:]
+	}
+	version, codec, code, size := fields[0], fields[1], fields[2], fields[3]
+	if version != cidVersion {
+		return Sum{}, fmt.Errorf("unsupported CID version %d", version)
+	}
+	flags := codec - epherCodec
+	if codec < epherCodec || flags > 3 {
+		return Sum{}, fmt.Errorf("not an epher sum, codec %#x", codec)
+	}
+	var typ Type
+	for t, c := range multihashCodes {
+		if c == code {
+			typ = t
+		}
+	}
+	if typ == 0 {
+		return Sum{}, fmt.Errorf("unsupported multihash %#x", code)
+	}
+	if size != uint64(len(buf)) || int(size) != typ.Size() {
+		return Sum{}, fmt.Errorf("%v digests are %d bytes, not %d", typ, typ.Size(), len(buf))
+	}
+	return Sum{Type: typ | Type(flags<<flagShift), Sum: string(buf)}, nil
+}
+
+func parseLegacySum(typ, digest string) (Sum, error) {
+	t, err := strconv.ParseUint(typ, 10, 16)
+	if err != nil {
+		return Sum{}, fmt.Errorf("invalid sum type: %v", err)
+	}
+	raw, err := hex.DecodeString(digest)
+	if err != nil {
+		return Sum{}, fmt.Errorf("invalid sum: %v", err)
+	}
+	return Sum{Type: Type(t), Sum: string(raw)}, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
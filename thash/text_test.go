@@ -0,0 +1,79 @@
+package thash
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumText(t *testing.T) {
+	h, err := New(SHA256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = h.Write([]byte("abc"))
+	sum := MakeSum(h)
+	assert.Equal(t, "bagaibqabciqlu6awx6hqdt7kifaubxs5vyrchmadmgrzmf32ts2bb73b6iablli", sum.String())
+
+	types := []Type{Blake2B512, SHA3, SHA256, Blake2B256, Blake3}
+	for _, typ := range types {
+		for _, flags := range []Type{0, Keyed, DomainSeparated, Keyed | DomainSeparated} {
+			want := Sum{Type: typ | flags, Sum: strings.Repeat("x", typ.Size())}
+			str := want.String()
+			assert.True(t, strings.HasPrefix(str, "b"), str)
+
+			got, err := ParseSum(str)
+			assert.NoError(t, err, str)
+			assert.Equal(t, want, got, str)
+		}
+	}
+
+	// as printed by older command lines
+	got, err := ParseSum(fmt.Sprintf("%d:%x", sum.Type, sum.Sum))
+	assert.NoError(t, err)
+	assert.Equal(t, sum, got)
+
+	for _, str := range []string{
+		"",
+		"nope",
+		"b",
+		"bzzzz",
+		sum.String()[:20],
+		sum.String() + "aa",
+		"f01" + "55" + "12" + "20" + strings.Repeat("00", 32), // not epher's codec
+	} {
+		_, err := ParseSum(str)
+		assert.Error(t, err, str)
+	}
+
+	assert.Equal(t, "Sum(Type(42):0123)", Sum{Type: 42, Sum: "\x01\x23"}.String())
+}
+
+func TestSumJSON(t *testing.T) {
+	h, err := New(Blake2B512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = h.Write([]byte("abc"))
+
+	type doc struct {
+		Sum   Sum  `json:"sum"`
+		Empty Sum  `json:"empty"`
+		Ptr   *Sum `json:"ptr"`
+	}
+	want := doc{Sum: MakeSum(h)}
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, `{"sum":"`+want.Sum.String()+`","empty":"","ptr":null}`, string(data))
+
+	var got doc
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	assert.Equal(t, want, got)
+}